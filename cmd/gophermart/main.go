@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"go.uber.org/zap"
 	"net/http"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"yapracticum-go-diploma-1/internal/handlers"
 	"yapracticum-go-diploma-1/internal/storage"
 	"yapracticum-go-diploma-1/internal/utils"
+	"yapracticum-go-diploma-1/internal/webhooks"
 )
 
 var logger *zap.Logger
@@ -26,39 +29,78 @@ func main() {
 		panic(err)
 	}
 
-	cfg := config.New()
-	newOrdersCh := make(chan storage.OrderTag, 1000)
-	dbStorage, err = storage.New(cfg, logger, newOrdersCh)
+	cfg, err := config.New()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	dbStorage, err = storage.New(cfg, logger)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	dbStorage.Init(parentContext)
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "migrate" {
+			logger.Fatal("Unknown command: " + args[0])
+		}
+		err = runMigrate(parentContext, dbStorage, args[1:])
+		dbStorage.Close(parentContext)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+		return
+	}
+
+	if err = dbStorage.Init(parentContext); err != nil {
+		if errors.Is(err, storage.ErrSchemaTooNew) {
+			logger.Fatal(err.Error())
+		}
+		logger.Error(err.Error())
+	}
 
 	workersWg := sync.WaitGroup{}
 	ccw := utils.NewCtxCancelWaiter(parentContext, 0)
-	accrualPoll := accrualpoll.NewAccrualPollWorker(ccw, dbStorage, &workersWg, logger, cfg.AccrualAddress, newOrdersCh)
+	breaker := accrualpoll.NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerOpenTimeout)
+	accrualPoll := accrualpoll.NewAccrualPollWorker(ccw, dbStorage, &workersWg, logger,
+		accrualpoll.NewHTTPAccrualClient(cfg.AccrualAddress, cfg.AccrualTimeout),
+		breaker,
+		accrualpoll.NewRateLimiter(cfg.AccrualRPS),
+		utils.RetryPolicy{
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+			Jitter:      cfg.RetryJitter,
+			MaxAge:      cfg.RetryMaxAge,
+			MaxAttempts: cfg.RetryMaxAttempts,
+		})
 	accrualPoll.StartPoll(5)
-	go accrualPoll.GetUnhandledOrders(parentContext)
+	webhookWorker := webhooks.NewWebhookWorker(ccw, dbStorage, &workersWg, logger,
+		cfg.WebhookTimeout,
+		utils.RetryPolicy{
+			BaseDelay:   cfg.WebhookRetryBase,
+			MaxDelay:    cfg.WebhookRetryMax,
+			Jitter:      0.2,
+			MaxAttempts: cfg.WebhookMaxAttempts,
+		},
+		cfg.WebhookPollPeriod,
+		cfg.WebhookEventsTTL)
+	webhookWorker.Start(2)
 
-	h := handlers.Handlers{Logger: logger, DBStorage: dbStorage, Cfg: cfg}
+	h := handlers.Handlers{Logger: logger, DBStorage: dbStorage, Cfg: cfg, Breaker: breaker}
 	server := http.Server{Addr: cfg.Endpoint, Handler: handlers.GophermartRouter(h)}
 
-	go shutdownSignal(parentContext, cancel, &workersWg, newOrdersCh, &server)
+	go shutdownSignal(parentContext, cancel, &workersWg, &server)
 
 	if err := server.ListenAndServe(); err != nil {
 		logger.Error(err.Error())
 	}
 }
 
-func shutdownSignal(ctx context.Context, cancel context.CancelFunc, workersWg *sync.WaitGroup, newOrdersCh chan storage.OrderTag, server *http.Server) {
+func shutdownSignal(ctx context.Context, cancel context.CancelFunc, workersWg *sync.WaitGroup, server *http.Server) {
 	terminateSignals := make(chan os.Signal, 1)
 	signal.Notify(terminateSignals, syscall.SIGTERM, syscall.SIGINT)
 	s := <-terminateSignals
 	logger.Info("Got one of stop signals, shutting down server gracefully, SIGNAL NAME :" + s.String())
-	dbStorage.Close(ctx)
 	cancel()
 	workersWg.Wait()
-	close(newOrdersCh)
+	dbStorage.Close(ctx)
 	server.Shutdown(ctx)
 }
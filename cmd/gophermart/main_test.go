@@ -94,9 +94,8 @@ func TestComplex(t *testing.T) {
 
 	//if logger, err = zap.NewProduction(); err != nil { panic(err) }
 
-	cfg := config.Config{ConnString: connstring, UseLuhn: false, Endpoint: "localhost:8080", AccrualAddress: "http://localhost:8090"}
-	newOrdersCh := make(chan storage.OrderTag, 300)
-	dbStorage, err = storage.New(cfg, logger, newOrdersCh)
+	cfg := config.Config{ConnString: connstring, UseLuhn: false, Endpoint: "localhost:8080", AccrualAddress: "http://localhost:8090", AccrualRPS: 100}
+	dbStorage, err = storage.New(cfg, logger)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -105,14 +104,24 @@ func TestComplex(t *testing.T) {
 
 	workersWg := sync.WaitGroup{}
 	ccw := utils.NewCtxCancelWaiter(parentContext, 0)
-	accrualPoll := accrualpoll.NewAccrualPollWorker(ccw, dbStorage, &workersWg, logger, cfg.AccrualAddress, newOrdersCh)
+	breaker := accrualpoll.NewCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerOpenTimeout)
+	accrualPoll := accrualpoll.NewAccrualPollWorker(ccw, dbStorage, &workersWg, logger,
+		accrualpoll.NewHTTPAccrualClient(cfg.AccrualAddress, cfg.AccrualTimeout),
+		breaker,
+		accrualpoll.NewRateLimiter(cfg.AccrualRPS),
+		utils.RetryPolicy{
+			BaseDelay:   cfg.RetryBaseDelay,
+			MaxDelay:    cfg.RetryMaxDelay,
+			Jitter:      cfg.RetryJitter,
+			MaxAge:      cfg.RetryMaxAge,
+			MaxAttempts: cfg.RetryMaxAttempts,
+		})
 	accrualPoll.StartPoll(5)
-	go accrualPoll.GetUnhandledOrders(parentContext)
 
-	h := handlers.Handlers{Logger: logger, DBStorage: dbStorage, Cfg: cfg}
+	h := handlers.Handlers{Logger: logger, DBStorage: dbStorage, Cfg: cfg, Breaker: breaker}
 	server := http.Server{Addr: cfg.Endpoint, Handler: handlers.GophermartRouter(h)}
 
-	go shutdownSignal(parentContext, cancel, &workersWg, newOrdersCh, &server)
+	go shutdownSignal(parentContext, cancel, &workersWg, &server)
 
 	//////////////////////
 	// Setup accrual
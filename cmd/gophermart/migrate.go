@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+// gophermart [flags] migrate up|down [steps]|status
+func runMigrate(ctx context.Context, s *storage.Storage, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: gophermart [flags] migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := s.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migrations, schema version %d\n", applied, storage.LatestSchemaVersion())
+		return nil
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("incorrect number of steps: %s", args[1])
+			}
+		}
+		return s.MigrateDown(ctx, steps)
+	case "status":
+		status, err := s.MigrationStatus(ctx)
+		for _, v := range status {
+			appliedAt := "pending"
+			if v.Applied {
+				appliedAt = v.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(os.Stdout, "%04d_%-20s %s\n", v.Version, v.Name, appliedAt)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+}
@@ -1,78 +1,118 @@
 package accrualpoll
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
-	"golang.org/x/net/context"
-	"net/http"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 	"yapracticum-go-diploma-1/internal/storage"
 	"yapracticum-go-diploma-1/internal/utils"
 )
 
+// AccrualJobStorage: part of storage used by poll workers
+type AccrualJobStorage interface {
+	SetAccrualJobListener(listener func(orderNum string, due time.Time))
+	ListAccrualJobs(ctx context.Context, before time.Time) ([]storage.AccrualJobDue, error)
+	ClaimAccrualJobs(ctx context.Context, workerID string, orderNum string, limit int, lease time.Duration) ([]storage.AccrualJob, error)
+	GetAccrualJobDue(ctx context.Context, orderNum string) (time.Time, bool, error)
+	RescheduleAccrualJob(ctx context.Context, orderNum string, nextPollAt time.Time, lastError string) error
+	CompleteAccrualJob(ctx context.Context, orderNum string) error
+	MarkAccrualJobStuck(ctx context.Context, orderNum string, lastError string) error
+	ApplyAccrualResponse(ctx context.Context, resp storage.AccrualResponse) error
+}
+
 type AccrualPollWorker struct {
-	s               *storage.Storage
-	wg              *sync.WaitGroup
-	logger          *zap.Logger
-	accrualAddress  string
-	data            chan storage.OrderTag
-	ccw             *utils.CtxCancelWaiter
-	dbPollPeriod    time.Duration
-	orderPollPeriod time.Duration
-	lastDBPoll      time.Time
-	lastDBPollM     *sync.RWMutex
+	s            AccrualJobStorage
+	wg           *sync.WaitGroup
+	logger       *zap.Logger
+	client       AccrualClient
+	breaker      *CircuitBreaker
+	limiter      *RateLimiter
+	ccw          *utils.CtxCancelWaiter
+	queue        *DelayQueue
+	dbPollPeriod time.Duration // Period of loading due jobs from database into queue
+	policy       utils.RetryPolicy
+	jobLease     time.Duration // How long claimed job is hidden from other workers
+	instanceID   string        // Distinguishes workers of different replicas
 }
 
 func NewAccrualPollWorker(
 	ccw *utils.CtxCancelWaiter,
-	s *storage.Storage,
+	s AccrualJobStorage,
 	wg *sync.WaitGroup,
 	logger *zap.Logger,
-	accrualAddress string,
-	data chan storage.OrderTag) *AccrualPollWorker {
-	if cap(data) < 10 {
-		panic("Channel for processing orders must be buffered with capacity >= 10")
+	client AccrualClient,
+	breaker *CircuitBreaker,
+	limiter *RateLimiter,
+	policy utils.RetryPolicy) *AccrualPollWorker {
+	hostname, _ := os.Hostname()
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = 5 * time.Second
 	}
 	return &AccrualPollWorker{
-		s:               s,
-		wg:              wg,
-		logger:          logger,
-		accrualAddress:  accrualAddress,
-		data:            data,
-		ccw:             ccw,
-		dbPollPeriod:    time.Minute,
-		orderPollPeriod: 5 * time.Second,
-		lastDBPoll:      time.Now().Add(-time.Second),
-		lastDBPollM:     &sync.RWMutex{},
-	}
-}
-
-func (apw *AccrualPollWorker) pushTag(tag storage.OrderTag) {
-	select {
-	case apw.data <- tag:
-	default:
-		apw.logger.Sugar().Warnf("Order %s dropped by AccrualPollWorker due to high load", tag.OrderNum)
+		s:            s,
+		wg:           wg,
+		logger:       logger,
+		client:       client,
+		breaker:      breaker,
+		limiter:      limiter,
+		ccw:          ccw,
+		queue:        NewDelayQueue(),
+		dbPollPeriod: time.Minute,
+		policy:       policy,
+		jobLease:     time.Minute,
+		instanceID:   fmt.Sprintf("%s:%d", hostname, os.Getpid()),
 	}
 }
 
 func (apw *AccrualPollWorker) StartPoll(numWorkers int) {
+	apw.s.SetAccrualJobListener(apw.queue.Push)
+	apw.wg.Add(1)
+	go apw.RefillQueue()
 	for i := 1; i <= numWorkers; i++ {
+		apw.wg.Add(1)
 		go apw.DoWork(i)
 	}
 }
 
+// RefillQueue periodically loads jobs, which become due before next refill: jobs left after restart,
+// created or rescheduled by other replicas, or with expired lease
+func (apw *AccrualPollWorker) RefillQueue() {
+	apw.logger.Info("RefillQueue worker started")
+	defer func() {
+		apw.logger.Info("RefillQueue worker stopped")
+		apw.wg.Done()
+	}()
+
+	ccw := utils.NewCtxCancelWaiter(apw.ccw.Ctx, apw.dbPollPeriod)
+	for {
+		if ccw.Scan() != nil {
+			return
+		}
+
+		jobs, err := apw.s.ListAccrualJobs(ccw.Ctx, time.Now().Add(apw.dbPollPeriod))
+		if err != nil {
+			apw.logger.Sugar().Errorf("Unable to load accrual jobs: %s", err.Error())
+			continue
+		}
+		for _, v := range jobs {
+			apw.queue.Push(v.OrderNum, v.Due)
+		}
+		apw.logger.Sugar().Infof("Pull accrual jobs from database: %d, queued: %d", len(jobs), apw.queue.Len())
+	}
+}
+
 func (apw *AccrualPollWorker) DoWork(id int) {
-	apw.wg.Add(1)
 	apw.logger.Info(fmt.Sprintf("Accrual poll worker %d started", id))
 	defer func() {
 		apw.logger.Info(fmt.Sprintf("Accrual poll worker %d stopped", id))
 		apw.wg.Done()
 	}()
 
-	var lastPoll time.Time
+	workerID := fmt.Sprintf("%s/%d", apw.instanceID, id)
 
 	for {
 
@@ -80,111 +120,156 @@ func (apw *AccrualPollWorker) DoWork(id int) {
 			return
 		}
 
-		select {
-		case order := <-apw.data:
-			// Will poll later
-			if order.PollAfter.After(time.Now()) {
-				apw.pushTag(order)
-				continue
-			}
-			// OrderTag Expired! (It's copy already pulled from database)
-			apw.lastDBPollM.RLock()
-			lastPoll = apw.lastDBPoll
-			apw.lastDBPollM.RUnlock()
-			if order.IssuedAt.Before(lastPoll) {
-				apw.logger.Sugar().Infof("Skip order %s, Issued: %v, Now: %v", order.OrderNum, order.IssuedAt, time.Now())
-				continue
-			}
+		// Wait for the earliest order to become due
+		orderNum, err := apw.queue.Pop(apw.ccw.Ctx)
+		if err != nil {
+			return
+		}
 
-			apw.logger.Info(fmt.Sprintf("Worker %d. Accrual Request: %s/api/orders/%s", id, apw.accrualAddress, order.OrderNum))
+		// Requests may have been paused while waiting
+		if apw.ccw.Scan() != nil {
+			return
+		}
 
-			resp, err := http.Get(fmt.Sprintf("%s/api/orders/%s", apw.accrualAddress, order.OrderNum))
-			if err != nil {
-				apw.pushTag(storage.OrderTag{OrderNum: order.OrderNum, PollAfter: time.Now().Add(5 * time.Second)})
-				continue
-			}
+		// Requests rate is shared by all workers
+		if apw.limiter.Wait(apw.ccw.Ctx) != nil {
+			return
+		}
 
-			respData := make([]byte, resp.ContentLength)
-			resp.Body.Read(respData)
-			resp.Body.Close()
-
-			apw.logger.Info(fmt.Sprintf("Worker %d. Accrual Response: %s, Status: %d", id, string(respData), resp.StatusCode))
-
-			switch resp.StatusCode {
-			case http.StatusOK:
-				var respParsed storage.AccrualResponse
-				err = json.Unmarshal(respData, &respParsed)
-				if err != nil {
-					apw.pushTag(storage.OrderTag{OrderNum: order.OrderNum, PollAfter: time.Now().Add(5 * time.Second)})
-					continue
-				}
-
-				err = apw.s.ApplyAccrualResponse(apw.ccw.Ctx, respParsed)
-				if err != nil {
-					apw.logger.Error(err.Error())
-				}
-
-				if (respParsed.Status != "PROCESSED" && respParsed.Status != "INVALID") || err != nil {
-					apw.pushTag(storage.OrderTag{OrderNum: order.OrderNum, PollAfter: time.Now().Add(apw.orderPollPeriod), IssuedAt: order.IssuedAt})
-				}
-
-			case http.StatusTooManyRequests:
-				apw.pushTag(order)
-				raHeader := resp.Header.Get("Retry-After")
-				retryTime, err := strconv.Atoi(raHeader)
-				if err != nil {
-					retryTime = 10
-				}
-				apw.ccw.SetTimeUntil(time.Now().Add(time.Duration(retryTime) * time.Second))
-
-			default:
-				apw.logger.Sugar().Errorf("Unexpected Accrual response code: %d, body: %s", resp.StatusCode, respData)
-			}
-		default:
-			time.Sleep(1 * time.Millisecond)
+		// Accrual system is unavailable or probe request is in flight
+		if ok, until := apw.breaker.Allow(); !ok {
+			apw.queue.Push(orderNum, until)
+			apw.ccw.SetTimeUntil(until)
+			continue
+		}
 
+		// Job is claimed in database, so other replicas won't poll it simultaneously
+		jobs, err := apw.s.ClaimAccrualJobs(apw.ccw.Ctx, workerID, orderNum, 1, apw.jobLease)
+		if err != nil {
+			apw.breaker.Release()
+			apw.logger.Sugar().Errorf("Worker %d. Unable to claim accrual job: %s", id, err.Error())
+			apw.queue.Push(orderNum, time.Now().Add(apw.policy.BaseDelay))
+			continue
+		}
+		if len(jobs) == 0 {
+			// Claimed by other replica, rescheduled or completed
+			apw.breaker.Release()
+			apw.requeue(orderNum)
+			continue
 		}
+
+		apw.poll(id, jobs[0])
 	}
 }
 
-func (apw *AccrualPollWorker) GetUnhandledOrders(ctx context.Context) {
-	apw.wg.Add(1)
-	apw.logger.Info("GetUnhandledOrders worker started")
-	defer func() {
-		apw.logger.Info("GetUnhandledOrders worker stopped")
-		apw.wg.Done()
-	}()
+// requeue queues order, which was not claimed, at due time of its job. Completed and stuck jobs are dropped.
+func (apw *AccrualPollWorker) requeue(orderNum string) {
+	due, pending, err := apw.s.GetAccrualJobDue(apw.ccw.Ctx, orderNum)
+	if err != nil {
+		apw.logger.Sugar().Errorf("Unable to get accrual job of order %s: %s", orderNum, err.Error())
+		apw.queue.Push(orderNum, time.Now().Add(apw.policy.BaseDelay))
+		return
+	}
+	if pending {
+		apw.queue.Push(orderNum, due)
+	}
+}
 
-	var iTime time.Time
+func (apw *AccrualPollWorker) reschedule(job storage.AccrualJob, after time.Duration, reason string) {
+	next := time.Now().Add(after)
+	err := apw.s.RescheduleAccrualJob(apw.ccw.Ctx, job.OrderNum, next, reason)
+	if err != nil {
+		// Job lease expires and job will be claimed again
+		apw.logger.Sugar().Errorf("Unable to reschedule order %s: %s", job.OrderNum, err.Error())
+		next = time.Now().Add(apw.jobLease)
+	}
+	apw.queue.Push(job.OrderNum, next)
+}
 
-	ccw := utils.NewCtxCancelWaiter(ctx, apw.dbPollPeriod)
-	for {
-		if ccw.Scan() != nil {
-			return
+// retry reschedules job according to retry policy, or marks it stuck if policy limits are exceeded
+func (apw *AccrualPollWorker) retry(job storage.AccrualJob, reason string) {
+	if apw.policy.GiveUp(job.Attempts, job.Since) {
+		apw.logger.Sugar().Warnf("Order %s is stuck after %d attempts since %v, last error: %s",
+			job.OrderNum, job.Attempts, job.Since.Format(time.RFC3339), reason)
+		if err := apw.s.MarkAccrualJobStuck(apw.ccw.Ctx, job.OrderNum, reason); err != nil {
+			apw.logger.Sugar().Errorf("Unable to mark order %s stuck: %s", job.OrderNum, err.Error())
+		}
+		return
+	}
+	apw.reschedule(job, apw.policy.Delay(job.Attempts), reason)
+}
+
+// recordBreaker updates circuit breaker with request result and pauses or resumes all workers
+func (apw *AccrualPollWorker) recordBreaker(id int, err error) {
+	switch {
+	case apw.ccw.Ctx.Err() != nil:
+		apw.breaker.Release()
+	case IsBreakerFailure(err):
+		if until := apw.breaker.Failure(); !until.IsZero() {
+			apw.logger.Sugar().Warnf("Worker %d. Accrual system is unavailable, requests paused until %s",
+				id, until.Format(time.RFC3339))
+			apw.ccw.SetTimeUntil(until)
+		}
+	default:
+		if apw.breaker.Success() {
+			apw.logger.Sugar().Infof("Worker %d. Accrual system is available, requests resumed", id)
+			apw.ccw.SetTimeUntil(time.Now())
 		}
+	}
+}
 
-		orders, err := apw.s.GetUnhandledOrders(ccw.Ctx)
-		if err != nil {
-			continue
+func (apw *AccrualPollWorker) poll(id int, job storage.AccrualJob) {
+	apw.logger.Info(fmt.Sprintf("Worker %d. Accrual Request: order %s", id, job.OrderNum))
+
+	respParsed, retryAfter, err := apw.client.GetOrder(apw.ccw.Ctx, job.OrderNum)
+	apw.recordBreaker(id, err)
+
+	switch {
+	case err == nil:
+		apw.limiter.OnSuccess()
+		apw.logger.Info(fmt.Sprintf("Worker %d. Accrual Response: order %s, status %s", id, respParsed.Order, respParsed.Status))
+
+		final := respParsed.Status == "PROCESSED" || respParsed.Status == "INVALID"
+		err = apw.s.ApplyAccrualResponse(apw.ccw.Ctx, respParsed)
+		switch {
+		case err == nil && final:
+			// Job was completed within accrual transaction
+		case errors.Is(err, storage.ErrNoDataChanged) && final:
+			// Order was finalized before
+			if err = apw.s.CompleteAccrualJob(apw.ccw.Ctx, job.OrderNum); err != nil {
+				apw.logger.Error(err.Error())
+			}
+		case err != nil:
+			apw.logger.Error(err.Error())
+			apw.retry(job, err.Error())
+		default:
+			apw.retry(job, "accrual status "+respParsed.Status)
 		}
 
-		apw.logger.Info("Pull orders from database")
-		if l := len(orders.Orders); l > 0 {
-			apw.logger.Sugar().Warnf("Found %d unhandled orders", l)
+	case errors.Is(err, ErrTooManyRequests):
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			apw.limiter.OnTooManyRequests(statusErr.Body)
+		}
+		apw.logger.Sugar().Warnf("Worker %d. Accrual requests rate limit decreased to %.2f rps", id, apw.limiter.Rate())
+		pause := time.Duration(retryAfter)
+		if pause == 0 {
+			pause = 10 * time.Second
 		}
+		apw.logger.Sugar().Warnf("Worker %d. Accrual requests paused for %v", id, pause)
+		apw.ccw.SetTimeUntil(time.Now().Add(pause))
+		apw.reschedule(job, pause, err.Error())
 
-		iTime = time.Now()
-		apw.lastDBPollM.Lock()
-		apw.lastDBPoll = iTime
-		apw.lastDBPollM.Unlock()
-		for _, v := range orders.Orders {
-			v := v
-			//select {
-			//case
-			apw.data <- storage.OrderTag{OrderNum: v.Number, PollAfter: iTime, IssuedAt: iTime}
-			// default: Must push all data to channel. If not enough time, service overloaded.
-			//}
+	case errors.Is(err, ErrOrderNotRegistered):
+		apw.limiter.OnSuccess()
+		apw.retry(job, err.Error())
+
+	default:
+		if apw.ccw.Ctx.Err() != nil {
+			// Shutdown: lease will expire and job will be claimed again
+			return
 		}
+		apw.logger.Sugar().Errorf("Worker %d. Accrual request for order %s failed: %s", id, job.OrderNum, err.Error())
+		apw.retry(job, err.Error())
 	}
-
 }
@@ -0,0 +1,166 @@
+package accrualpoll
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+type fakeJob struct {
+	nextPollAt  time.Time
+	lockedUntil time.Time
+}
+
+// fakeJobStorage keeps accrual jobs in memory with the same claim rules as database
+type fakeJobStorage struct {
+	m    sync.Mutex
+	jobs map[string]*fakeJob
+}
+
+func (fs *fakeJobStorage) SetAccrualJobListener(func(string, time.Time)) {}
+
+func (fs *fakeJobStorage) ListAccrualJobs(context.Context, time.Time) ([]storage.AccrualJobDue, error) {
+	return nil, nil
+}
+
+func (fs *fakeJobStorage) ClaimAccrualJobs(_ context.Context, _ string, orderNum string, limit int, lease time.Duration) ([]storage.AccrualJob, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	now := time.Now()
+	res := make([]storage.AccrualJob, 0)
+	for num, job := range fs.jobs {
+		if len(res) == limit || (orderNum != "" && num != orderNum) {
+			continue
+		}
+		if job.nextPollAt.After(now) || job.lockedUntil.After(now) {
+			continue
+		}
+		job.lockedUntil = now.Add(lease)
+		res = append(res, storage.AccrualJob{OrderNum: num, Attempts: 1, CreatedAt: now, Since: now})
+	}
+	return res, nil
+}
+
+func (fs *fakeJobStorage) GetAccrualJobDue(_ context.Context, orderNum string) (time.Time, bool, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	job, ok := fs.jobs[orderNum]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	if job.lockedUntil.After(job.nextPollAt) {
+		return job.lockedUntil, true, nil
+	}
+	return job.nextPollAt, true, nil
+}
+
+func (fs *fakeJobStorage) RescheduleAccrualJob(_ context.Context, orderNum string, nextPollAt time.Time, _ string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	if job, ok := fs.jobs[orderNum]; ok {
+		job.nextPollAt = nextPollAt
+		job.lockedUntil = time.Time{}
+	}
+	return nil
+}
+
+func (fs *fakeJobStorage) CompleteAccrualJob(_ context.Context, orderNum string) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	delete(fs.jobs, orderNum)
+	return nil
+}
+
+func (fs *fakeJobStorage) MarkAccrualJobStuck(ctx context.Context, orderNum string, _ string) error {
+	return fs.CompleteAccrualJob(ctx, orderNum)
+}
+
+func (fs *fakeJobStorage) ApplyAccrualResponse(ctx context.Context, resp storage.AccrualResponse) error {
+	return fs.CompleteAccrualJob(ctx, resp.Order)
+}
+
+func (fs *fakeJobStorage) pending(orderNum string) bool {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	_, ok := fs.jobs[orderNum]
+	return ok
+}
+
+// fakeAccrualClient answers PROCESSED and reports polled orders
+type fakeAccrualClient struct {
+	polled chan string
+}
+
+func (fc *fakeAccrualClient) GetOrder(_ context.Context, number string) (storage.AccrualResponse, RetryAfter, error) {
+	fc.polled <- number
+	return storage.AccrualResponse{Order: number, Status: "PROCESSED"}, 0, nil
+}
+
+func startTestWorker(t *testing.T, fs *fakeJobStorage, orders ...string) (*AccrualPollWorker, chan string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	client := &fakeAccrualClient{polled: make(chan string, 10)}
+	apw := NewAccrualPollWorker(utils.NewCtxCancelWaiter(ctx, 0), fs, wg, zap.NewNop(), client,
+		NewCircuitBreaker(5, time.Second), NewRateLimiter(1000), utils.RetryPolicy{BaseDelay: time.Second})
+	for _, orderNum := range orders {
+		apw.queue.Push(orderNum, time.Now())
+	}
+	wg.Add(1)
+	go apw.DoWork(1)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	return apw, client.polled
+}
+
+func TestDoWork(t *testing.T) {
+	t.Run("Claims popped order, not the first due job", func(t *testing.T) {
+		fs := &fakeJobStorage{jobs: map[string]*fakeJob{
+			"1": {nextPollAt: time.Now().Add(-time.Hour)},
+			"2": {nextPollAt: time.Now().Add(-time.Minute)},
+		}}
+		_, polled := startTestWorker(t, fs, "2")
+
+		select {
+		case got := <-polled:
+			assert.Equal(t, "2", got)
+		case <-time.After(time.Second):
+			t.Fatal("popped order was not polled")
+		}
+		assert.True(t, fs.pending("1"), "Job of other order must stay unclaimed")
+	})
+
+	t.Run("Requeues order claimed by other replica", func(t *testing.T) {
+		fs := &fakeJobStorage{jobs: map[string]*fakeJob{
+			"1": {nextPollAt: time.Now().Add(-time.Minute), lockedUntil: time.Now().Add(100 * time.Millisecond)},
+		}}
+		_, polled := startTestWorker(t, fs, "1")
+
+		select {
+		case got := <-polled:
+			assert.Equal(t, "1", got)
+		case <-time.After(time.Second):
+			t.Fatal("order was not polled after lease expiration")
+		}
+	})
+
+	t.Run("Drops order without pending job", func(t *testing.T) {
+		fs := &fakeJobStorage{jobs: map[string]*fakeJob{}}
+		apw, polled := startTestWorker(t, fs, "1")
+
+		require.Eventually(t, func() bool { return apw.queue.Len() == 0 }, time.Second, 10*time.Millisecond)
+		select {
+		case got := <-polled:
+			t.Fatalf("order %s without job was polled", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.Equal(t, 0, apw.queue.Len())
+	})
+}
@@ -0,0 +1,171 @@
+package accrualpoll
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+//////////////////////////
+// CircuitBreaker: stops polling of unavailable accrual system
+//////////////////////////
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+var breakerStateGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "gophermart_accrual_breaker_state",
+	Help: "Accrual system circuit breaker state: 0 - closed, 1 - half-open, 2 - open",
+})
+
+var breakerTripsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "gophermart_accrual_breaker_trips_total",
+	Help: "Number of accrual system circuit breaker transitions to open state",
+})
+
+func init() {
+	prometheus.MustRegister(breakerStateGauge, breakerTripsCounter)
+}
+
+type CircuitBreaker struct {
+	m             sync.Mutex
+	state         BreakerState
+	failures      int           // Consecutive failures in closed state
+	threshold     int           // Breaker opens after this number of consecutive failures
+	openTimeout   time.Duration // Time in open state before probe request
+	openUntil     time.Time
+	probeInFlight bool
+}
+
+// BreakerStatus: breaker state snapshot for health endpoint
+type BreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+func NewCircuitBreaker(threshold int, openTimeout time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if openTimeout <= 0 {
+		openTimeout = 30 * time.Second
+	}
+	breakerStateGauge.Set(float64(BreakerClosed))
+	return &CircuitBreaker{threshold: threshold, openTimeout: openTimeout}
+}
+
+// IsBreakerFailure reports whether error means accrual system is unavailable
+func IsBreakerFailure(err error) bool {
+	return errors.Is(err, ErrTransport) || errors.Is(err, ErrAccrualUnavailable)
+}
+
+func (cb *CircuitBreaker) setState(state BreakerState) {
+	cb.state = state
+	breakerStateGauge.Set(float64(state))
+}
+
+// Allow reports whether request may be sent. If not, returns moment to wait for.
+// After open timeout single probe request is allowed (half-open state).
+func (cb *CircuitBreaker) Allow() (bool, time.Time) {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		if time.Now().Before(cb.openUntil) {
+			return false, cb.openUntil
+		}
+		cb.setState(BreakerHalfOpen)
+		cb.probeInFlight = true
+		return true, time.Time{}
+	case BreakerHalfOpen:
+		if cb.probeInFlight {
+			// Probe result will wake up waiting workers
+			return false, time.Now().Add(cb.openTimeout)
+		}
+		cb.probeInFlight = true
+		return true, time.Time{}
+	}
+	return true, time.Time{}
+}
+
+// Success records response of accrual system. Returns true if breaker was closed by it.
+func (cb *CircuitBreaker) Success() bool {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	cb.failures = 0
+	cb.probeInFlight = false
+	if cb.state == BreakerClosed {
+		return false
+	}
+	cb.setState(BreakerClosed)
+	return true
+}
+
+// Failure records unavailability of accrual system. Returns moment until which requests are stopped
+// (zero if breaker is still closed).
+func (cb *CircuitBreaker) Failure() time.Time {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+
+	switch cb.state {
+	case BreakerClosed:
+		cb.failures++
+		if cb.failures < cb.threshold {
+			return time.Time{}
+		}
+	case BreakerOpen:
+		// Request was sent before breaker opened
+		return cb.openUntil
+	}
+
+	cb.probeInFlight = false
+	cb.openUntil = time.Now().Add(cb.openTimeout)
+	cb.setState(BreakerOpen)
+	breakerTripsCounter.Inc()
+	return cb.openUntil
+}
+
+// Release frees probe slot, if request was not completed (e.g. on shutdown)
+func (cb *CircuitBreaker) Release() {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	cb.probeInFlight = false
+}
+
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	return cb.state
+}
+
+func (cb *CircuitBreaker) Status() BreakerStatus {
+	cb.m.Lock()
+	defer cb.m.Unlock()
+	res := BreakerStatus{State: cb.state.String(), Failures: cb.failures}
+	if cb.state == BreakerOpen {
+		openUntil := cb.openUntil
+		res.OpenUntil = &openUntil
+	}
+	return res
+}
@@ -0,0 +1,77 @@
+package accrualpoll
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Run("Trips on consecutive failures", func(t *testing.T) {
+		cb := NewCircuitBreaker(3, time.Hour)
+		assert.True(t, cb.Failure().IsZero())
+		assert.True(t, cb.Failure().IsZero())
+		assert.False(t, cb.Success(), "Closed breaker is not closed again")
+		assert.True(t, cb.Failure().IsZero(), "Success resets failures counter")
+		assert.True(t, cb.Failure().IsZero())
+		until := cb.Failure()
+		assert.False(t, until.IsZero())
+		assert.Equal(t, BreakerOpen, cb.State())
+
+		ok, wait := cb.Allow()
+		assert.False(t, ok)
+		assert.Equal(t, until, wait)
+	})
+
+	t.Run("Single probe in half-open state", func(t *testing.T) {
+		cb := NewCircuitBreaker(1, 10*time.Millisecond)
+		cb.Failure()
+		time.Sleep(20 * time.Millisecond)
+
+		ok, _ := cb.Allow()
+		assert.True(t, ok)
+		assert.Equal(t, BreakerHalfOpen, cb.State())
+		ok, _ = cb.Allow()
+		assert.False(t, ok, "Only one probe request is allowed")
+
+		assert.True(t, cb.Success())
+		assert.Equal(t, BreakerClosed, cb.State())
+		ok, _ = cb.Allow()
+		assert.True(t, ok)
+	})
+
+	t.Run("Failed probe opens breaker", func(t *testing.T) {
+		cb := NewCircuitBreaker(5, 10*time.Millisecond)
+		for i := 0; i < 5; i++ {
+			cb.Failure()
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		ok, _ := cb.Allow()
+		assert.True(t, ok)
+		assert.False(t, cb.Failure().IsZero(), "Single failed probe opens breaker")
+		assert.Equal(t, BreakerOpen, cb.State())
+	})
+
+	t.Run("Released probe", func(t *testing.T) {
+		cb := NewCircuitBreaker(1, 10*time.Millisecond)
+		cb.Failure()
+		time.Sleep(20 * time.Millisecond)
+
+		ok, _ := cb.Allow()
+		assert.True(t, ok)
+		cb.Release()
+		ok, _ = cb.Allow()
+		assert.True(t, ok)
+	})
+
+	t.Run("Failure classification", func(t *testing.T) {
+		assert.True(t, IsBreakerFailure(fmt.Errorf("%w: timeout", ErrTransport)))
+		assert.True(t, IsBreakerFailure(&StatusError{StatusCode: 503}))
+		assert.False(t, IsBreakerFailure(&StatusError{StatusCode: 429}))
+		assert.False(t, IsBreakerFailure(&StatusError{StatusCode: 204}))
+		assert.False(t, IsBreakerFailure(ErrInvalidResponse))
+		assert.False(t, IsBreakerFailure(nil))
+	})
+}
@@ -0,0 +1,130 @@
+package accrualpoll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+//////////////////////////
+// Accrual system client
+//////////////////////////
+
+// RetryAfter: delay requested by accrual system (zero if not requested)
+type RetryAfter time.Duration
+
+type AccrualClient interface {
+	GetOrder(ctx context.Context, number string) (storage.AccrualResponse, RetryAfter, error)
+}
+
+var ErrOrderNotRegistered error = errors.New("order is not registered in accrual system")
+var ErrTooManyRequests error = errors.New("accrual system request limit exceeded")
+var ErrAccrualUnavailable error = errors.New("accrual system internal error")
+var ErrUnexpectedStatus error = errors.New("unexpected accrual system response code")
+var ErrInvalidResponse error = errors.New("invalid accrual system response")
+var ErrTransport error = errors.New("accrual system is unreachable")
+
+// StatusError: accrual system answered with non-200 status code
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("accrual system response code %d, body: %s", e.StatusCode, e.Body)
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusNoContent:
+		return ErrOrderNotRegistered
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case e.StatusCode >= 500:
+		return ErrAccrualUnavailable
+	default:
+		return ErrUnexpectedStatus
+	}
+}
+
+//////////////////////////
+// HTTP implementation
+//////////////////////////
+
+const maxAccrualResponseSize = 1 << 20
+
+type HTTPAccrualClient struct {
+	address string
+	client  *http.Client
+}
+
+func NewHTTPAccrualClient(address string, timeout time.Duration) *HTTPAccrualClient {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	return &HTTPAccrualClient{
+		address: strings.TrimRight(address, "/"),
+		client:  &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+func (c *HTTPAccrualClient) GetOrder(ctx context.Context, number string) (storage.AccrualResponse, RetryAfter, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/orders/%s", c.address, url.PathEscape(number)), nil)
+	if err != nil {
+		return storage.AccrualResponse{}, 0, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return storage.AccrualResponse{}, 0, fmt.Errorf("%w: %w", ErrTransport, err)
+	}
+	defer resp.Body.Close()
+
+	respData, err := io.ReadAll(io.LimitReader(resp.Body, maxAccrualResponseSize))
+	if err != nil {
+		return storage.AccrualResponse{}, 0, fmt.Errorf("%w: %w", ErrTransport, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return storage.AccrualResponse{}, parseRetryAfter(resp.Header.Get("Retry-After")),
+			&StatusError{StatusCode: resp.StatusCode, Body: string(respData)}
+	}
+
+	var respParsed storage.AccrualResponse
+	if err = json.Unmarshal(respData, &respParsed); err != nil {
+		return storage.AccrualResponse{}, 0, fmt.Errorf("%w: %w, body: %s", ErrInvalidResponse, err, respData)
+	}
+	return respParsed, 0, nil
+}
+
+// parseRetryAfter supports both delay-seconds and HTTP-date forms
+func parseRetryAfter(header string) RetryAfter {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return RetryAfter(time.Duration(seconds) * time.Second)
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(time.Now()) {
+		return RetryAfter(time.Until(date))
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+package accrualpoll
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func TestHTTPAccrualClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/orders/processed", func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length: response is sent chunked
+		w.Write([]byte(`{"order":"processed",`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`"status":"PROCESSED","accrual":500.50}`))
+	})
+	mux.HandleFunc("/api/orders/unknown", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/orders/limited", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("No more than 100 requests per minute allowed"))
+	})
+	mux.HandleFunc("/api/orders/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/api/orders/garbage", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"order":`))
+	})
+	mux.HandleFunc("/api/orders/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := NewHTTPAccrualClient(server.URL+"/", 200*time.Millisecond)
+	ctx := context.Background()
+
+	t.Run("Processed chunked response", func(t *testing.T) {
+		resp, retryAfter, err := client.GetOrder(ctx, "processed")
+		require.NoError(t, err)
+		assert.Equal(t, RetryAfter(0), retryAfter)
+		assert.Equal(t, "PROCESSED", resp.Status)
+		require.NotNil(t, resp.Accrual)
+		assert.Equal(t, storage.Numeric(50050), *resp.Accrual)
+	})
+
+	t.Run("204 Not registered", func(t *testing.T) {
+		_, _, err := client.GetOrder(ctx, "unknown")
+		assert.ErrorIs(t, err, ErrOrderNotRegistered)
+	})
+
+	t.Run("429 Too many requests", func(t *testing.T) {
+		_, retryAfter, err := client.GetOrder(ctx, "limited")
+		assert.ErrorIs(t, err, ErrTooManyRequests)
+		assert.Equal(t, RetryAfter(time.Minute), retryAfter)
+		var statusErr *StatusError
+		require.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, "No more than 100 requests per minute allowed", statusErr.Body)
+	})
+
+	t.Run("500 Internal error", func(t *testing.T) {
+		_, _, err := client.GetOrder(ctx, "broken")
+		assert.ErrorIs(t, err, ErrAccrualUnavailable)
+	})
+
+	t.Run("Invalid body", func(t *testing.T) {
+		_, _, err := client.GetOrder(ctx, "garbage")
+		assert.ErrorIs(t, err, ErrInvalidResponse)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		_, _, err := client.GetOrder(ctx, "slow")
+		assert.ErrorIs(t, err, ErrTransport)
+	})
+
+	t.Run("Cancelled context", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, _, err := client.GetOrder(cctx, "processed")
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
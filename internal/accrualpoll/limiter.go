@@ -0,0 +1,131 @@
+package accrualpoll
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//////////////////////////
+// RateLimiter: adaptive token bucket shared by all workers
+//////////////////////////
+
+var rateLimitGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "gophermart_accrual_rate_limit",
+	Help: "Current accrual system requests rate limit, requests per second",
+})
+
+func init() {
+	prometheus.MustRegister(rateLimitGauge)
+}
+
+var quotaRegexp = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+const (
+	minAccrualRate   = 0.1 // Rate is never decreased below one request per 10 seconds
+	rateRecoverSteps = 100 // Number of successful requests to ramp up from zero to ceiling
+)
+
+type RateLimiter struct {
+	m      sync.Mutex
+	rate   float64 // Current rate, requests per second
+	limit  float64 // Configured rate
+	quota  float64 // Rate learned from 429 response (0 - unknown)
+	tokens float64
+	last   time.Time // Moment of last tokens refill
+}
+
+func NewRateLimiter(rps float64) *RateLimiter {
+	if rps <= 0 {
+		rps = 10
+	}
+	rateLimitGauge.Set(rps)
+	return &RateLimiter{rate: rps, limit: rps, tokens: 1, last: time.Now()}
+}
+
+// ceiling: rate, which limiter ramps up to
+func (rl *RateLimiter) ceiling() float64 {
+	if rl.quota > 0 {
+		return math.Min(rl.limit, rl.quota)
+	}
+	return rl.limit
+}
+
+func (rl *RateLimiter) setRate(rate float64) {
+	rl.rate = math.Max(minAccrualRate, math.Min(rate, rl.ceiling()))
+	rateLimitGauge.Set(rl.rate)
+}
+
+// refill adds tokens for elapsed time. Bucket size is one second of requests.
+func (rl *RateLimiter) refill(now time.Time) {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	rl.tokens = math.Min(rl.tokens, math.Max(1, rl.rate))
+	rl.last = now
+}
+
+// Wait blocks until request is allowed or context is cancelled
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		rl.m.Lock()
+		rl.refill(time.Now())
+		if rl.tokens >= 1 {
+			rl.tokens--
+			rl.m.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		rl.m.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// OnSuccess slowly ramps rate up to ceiling (additive increase)
+func (rl *RateLimiter) OnSuccess() {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.rate < rl.ceiling() {
+		rl.setRate(rl.rate + rl.ceiling()/rateRecoverSteps)
+	}
+}
+
+// OnTooManyRequests halves rate (multiplicative decrease) and learns quota from response body
+func (rl *RateLimiter) OnTooManyRequests(body string) {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if quota, ok := parseQuota(body); ok {
+		rl.quota = quota
+	}
+	rl.refill(time.Now())
+	rl.tokens = 0
+	rl.setRate(rl.rate / 2)
+}
+
+func (rl *RateLimiter) Rate() float64 {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	return rl.rate
+}
+
+// parseQuota parses "No more than N requests per minute allowed" into requests per second
+func parseQuota(body string) (float64, bool) {
+	match := quotaRegexp.FindStringSubmatch(body)
+	if match == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(match[1])
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return float64(n) / 60, true
+}
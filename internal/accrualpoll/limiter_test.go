@@ -0,0 +1,72 @@
+package accrualpoll
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Limits requests rate", func(t *testing.T) {
+		rl := NewRateLimiter(50)
+		start := time.Now()
+		for i := 0; i < 11; i++ {
+			require.NoError(t, rl.Wait(ctx))
+		}
+		// First request is allowed immediately, the rest are spaced by 20ms
+		assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+	})
+
+	t.Run("Backs off and ramps up", func(t *testing.T) {
+		rl := NewRateLimiter(10)
+		rl.OnTooManyRequests("")
+		assert.InDelta(t, 5, rl.Rate(), 0.001)
+		rl.OnTooManyRequests("")
+		assert.InDelta(t, 2.5, rl.Rate(), 0.001)
+
+		rl.OnSuccess()
+		assert.InDelta(t, 2.6, rl.Rate(), 0.001)
+		for i := 0; i < 1000; i++ {
+			rl.OnSuccess()
+		}
+		assert.InDelta(t, 10, rl.Rate(), 0.001, "Rate is not increased above configured limit")
+	})
+
+	t.Run("Learns quota from 429 body", func(t *testing.T) {
+		rl := NewRateLimiter(10)
+		rl.OnTooManyRequests("No more than 60 requests per minute allowed")
+		assert.InDelta(t, 1, rl.Rate(), 0.001)
+		for i := 0; i < 1000; i++ {
+			rl.OnSuccess()
+		}
+		assert.InDelta(t, 1, rl.Rate(), 0.001, "Rate is not increased above learned quota")
+	})
+
+	t.Run("Never stops completely", func(t *testing.T) {
+		rl := NewRateLimiter(1)
+		for i := 0; i < 100; i++ {
+			rl.OnTooManyRequests("")
+		}
+		assert.InDelta(t, minAccrualRate, rl.Rate(), 0.001)
+	})
+
+	t.Run("Stops on context cancellation", func(t *testing.T) {
+		rl := NewRateLimiter(0.1)
+		require.NoError(t, rl.Wait(ctx))
+		cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, rl.Wait(cctx), context.DeadlineExceeded)
+	})
+
+	t.Run("Parse quota", func(t *testing.T) {
+		quota, ok := parseQuota("No more than 120 requests per minute allowed")
+		assert.True(t, ok)
+		assert.InDelta(t, 2, quota, 0.001)
+		_, ok = parseQuota("Ya zhe skazal, 429!")
+		assert.False(t, ok)
+	})
+}
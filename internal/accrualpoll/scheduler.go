@@ -0,0 +1,138 @@
+package accrualpoll
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+//////////////////////////
+// DelayQueue: timer heap of orders waiting for their poll time
+//////////////////////////
+
+type delayItem struct {
+	orderNum string
+	due      time.Time
+	index    int
+}
+
+type delayHeap []*delayItem
+
+func (dh delayHeap) Len() int           { return len(dh) }
+func (dh delayHeap) Less(i, j int) bool { return dh[i].due.Before(dh[j].due) }
+func (dh delayHeap) Swap(i, j int) {
+	dh[i], dh[j] = dh[j], dh[i]
+	dh[i].index = i
+	dh[j].index = j
+}
+
+func (dh *delayHeap) Push(x any) {
+	item := x.(*delayItem)
+	item.index = len(*dh)
+	*dh = append(*dh, item)
+}
+
+func (dh *delayHeap) Pop() any {
+	old := *dh
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*dh = old[:n-1]
+	return item
+}
+
+type DelayQueue struct {
+	m     sync.Mutex
+	items delayHeap
+	index map[string]*delayItem // Order can be queued only once
+	wake  chan struct{}         // Wakes one waiting consumer
+}
+
+func NewDelayQueue() *DelayQueue {
+	return &DelayQueue{
+		items: make(delayHeap, 0),
+		index: make(map[string]*delayItem),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func (dq *DelayQueue) signal() {
+	select {
+	case dq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Push schedules order. If order is already queued, the earliest due time is kept.
+func (dq *DelayQueue) Push(orderNum string, due time.Time) {
+	dq.m.Lock()
+	if item, ok := dq.index[orderNum]; ok {
+		if due.Before(item.due) {
+			item.due = due
+			heap.Fix(&dq.items, item.index)
+		}
+	} else {
+		item := &delayItem{orderNum: orderNum, due: due}
+		heap.Push(&dq.items, item)
+		dq.index[orderNum] = item
+	}
+	dq.m.Unlock()
+	dq.signal()
+}
+
+func (dq *DelayQueue) Len() int {
+	dq.m.Lock()
+	defer dq.m.Unlock()
+	return len(dq.items)
+}
+
+// next pops due item or returns time to wait for the earliest one (negative if queue is empty)
+func (dq *DelayQueue) next() (string, time.Duration, bool) {
+	dq.m.Lock()
+	defer dq.m.Unlock()
+	if len(dq.items) == 0 {
+		return "", -1, false
+	}
+	top := dq.items[0]
+	if wait := time.Until(top.due); wait > 0 {
+		return "", wait, false
+	}
+	heap.Pop(&dq.items)
+	delete(dq.index, top.orderNum)
+	return top.orderNum, 0, true
+}
+
+// Pop blocks until the earliest order is due or context is cancelled
+func (dq *DelayQueue) Pop(ctx context.Context) (string, error) {
+	for {
+		orderNum, wait, ok := dq.next()
+		if ok {
+			// Other consumers may be waiting for remaining items
+			if dq.Len() > 0 {
+				dq.signal()
+			}
+			return orderNum, nil
+		}
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timerC = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return "", ctx.Err()
+		case <-dq.wake:
+		case <-timerC:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
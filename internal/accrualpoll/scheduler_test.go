@@ -0,0 +1,106 @@
+package accrualpoll
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDelayQueue(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Pops in due order", func(t *testing.T) {
+		dq := NewDelayQueue()
+		now := time.Now()
+		dq.Push("3", now.Add(-time.Millisecond))
+		dq.Push("1", now.Add(-3*time.Millisecond))
+		dq.Push("2", now.Add(-2*time.Millisecond))
+
+		for _, want := range []string{"1", "2", "3"} {
+			got, err := dq.Pop(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		}
+	})
+
+	t.Run("Keeps earliest due of duplicate", func(t *testing.T) {
+		dq := NewDelayQueue()
+		dq.Push("1", time.Now().Add(time.Hour))
+		dq.Push("1", time.Now())
+		dq.Push("1", time.Now().Add(time.Hour))
+		assert.Equal(t, 1, dq.Len())
+
+		got, err := dq.Pop(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "1", got)
+	})
+
+	t.Run("Waits until due", func(t *testing.T) {
+		dq := NewDelayQueue()
+		start := time.Now()
+		dq.Push("1", start.Add(100*time.Millisecond))
+
+		got, err := dq.Pop(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "1", got)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("Wakes on earlier push", func(t *testing.T) {
+		dq := NewDelayQueue()
+		dq.Push("late", time.Now().Add(time.Hour))
+
+		res := make(chan string)
+		go func() {
+			got, _ := dq.Pop(ctx)
+			res <- got
+		}()
+		time.Sleep(20 * time.Millisecond)
+		dq.Push("early", time.Now())
+
+		select {
+		case got := <-res:
+			assert.Equal(t, "early", got)
+		case <-time.After(time.Second):
+			t.Fatal("consumer was not woken up")
+		}
+	})
+
+	t.Run("Wakes all consumers", func(t *testing.T) {
+		dq := NewDelayQueue()
+		res := make(chan string, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				got, _ := dq.Pop(ctx)
+				res <- got
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		dq.Push("1", time.Now())
+		dq.Push("2", time.Now())
+		dq.Push("3", time.Now())
+
+		got := make([]string, 0)
+		for i := 0; i < 3; i++ {
+			select {
+			case v := <-res:
+				got = append(got, v)
+			case <-time.After(time.Second):
+				t.Fatal("consumer was not woken up")
+			}
+		}
+		assert.ElementsMatch(t, []string{"1", "2", "3"}, got)
+	})
+
+	t.Run("Stops on context cancellation", func(t *testing.T) {
+		dq := NewDelayQueue()
+		dq.Push("1", time.Now().Add(time.Hour))
+		cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err := dq.Pop(cctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
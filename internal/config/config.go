@@ -2,25 +2,118 @@ package config
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Clawback policies: what to do, if clawed back accrual exceeds available balance
+const (
+	ClawbackReject  = "reject"  // Clawback is rejected
+	ClawbackDebt    = "debt"    // Available points are deducted, the rest becomes debt repaid from next accruals
+	ClawbackPartial = "partial" // Available points are deducted, the rest is forgiven
+)
+
+// Tier: loyalty tier, reached by points accrued within last 12 months
+type Tier struct {
+	Name       string
+	Threshold  int64   // Accrued points required, in cents
+	Multiplier float64 // Applied to accrual returned by accrual system
+}
+
 type Config struct {
-	ConnString     string
-	Endpoint       string
-	AccrualAddress string
-	UseLuhn        bool
-	AutoInitPeriod time.Duration
+	ConnString         string
+	Endpoint           string
+	AccrualAddress     string
+	UseLuhn            bool
+	AutoInitPeriod     time.Duration
+	JWTKeys            string // Inline JWT keys: "kid1:secret1,kid2:secret2"
+	JWTKeyFile         string // JSON file with JWT keys and their rotation schedule
+	KeyReloadPeriod    time.Duration
+	SessionCacheTTL    time.Duration
+	IdempotencyKeyTTL  time.Duration
+	HoldTTL            time.Duration // Default hold lifetime
+	HoldMaxTTL         time.Duration
+	HoldExpirePeriod   time.Duration
+	AccrualTimeout     time.Duration
+	PointsTTLMonths    int // Accrued points expire after this number of months (0 - never)
+	ExpiringSoonWindow time.Duration
+	PointsExpirePeriod time.Duration
+
+	// User events stream
+	UserEventsTTL         time.Duration // Events older than this are not available for resume (0 - events are kept)
+	UserEventsPurgePeriod time.Duration
+	UserEventsReconnect   time.Duration // Pause before reconnection of LISTEN connection
+	UserEventsHeartbeat   time.Duration // Comment is sent to idle event stream to keep connection open
+	AccrualRPS            float64       // Accrual system requests rate limit
+
+	// Accrual poll retry policy
+	RetryBaseDelay   time.Duration
+	RetryMaxDelay    time.Duration
+	RetryJitter      float64
+	RetryMaxAge      time.Duration
+	RetryMaxAttempts int
+
+	// Accrual system circuit breaker
+	BreakerThreshold   int
+	BreakerOpenTimeout time.Duration
+
+	ClawbackPolicy string
+
+	// Webhooks
+	WebhookPollPeriod  time.Duration // Period of dispatching outbox events and claiming due deliveries
+	WebhookTimeout     time.Duration
+	WebhookRetryBase   time.Duration
+	WebhookRetryMax    time.Duration
+	WebhookMaxAttempts int           // Delivery is failed after this number of attempts (0 - never)
+	WebhookEventsTTL   time.Duration // Events and delivery log are kept for this time
+
+	BatchOrdersMax int // Max number of orders in batch upload (0 - unlimited)
+
+	TransferDailyLimit int64 // Points, which user can transfer to others within 24 hours, in cents (0 - unlimited)
+
+	// Referral program: bonuses (in cents) for first processed order of referee
+	ReferrerBonus      int64
+	RefereeBonus       int64
+	ReferralMaxPerUser int // 0 - unlimited
+
+	Tiers []Tier // Sorted by threshold (empty - tiers are disabled)
+
+	AdminToken     string            // Bearer token of admin API (empty - admin API disabled)
+	MerchantTokens map[string]string // Merchant name by bearer token of merchant API
 }
 
-func New() Config {
+func New() (Config, error) {
 	var res Config
 
 	pConnString := flag.String("d", "", "Database connection string")
 	pEndpoint := flag.String("a", ":8080", "Server endpoint")
 	pAccrualAddress := flag.String("r", "localhost:8090", "Accrual system address")
 	pUseLuhn := flag.Bool("useLuhn", true, "Is Luhn required")
+	pJWTKeys := flag.String("k", "", "JWT signing keys (kid1:secret1,kid2:secret2)")
+	pJWTKeyFile := flag.String("kf", "", "JWT signing keys file")
+	pRetryBaseDelay := flag.Duration("retryBase", 5*time.Second, "Accrual poll retry base delay")
+	pRetryMaxDelay := flag.Duration("retryMax", 10*time.Minute, "Accrual poll retry max delay")
+	pRetryJitter := flag.Float64("retryJitter", 0.2, "Accrual poll retry jitter (part of delay)")
+	pRetryMaxAge := flag.Duration("retryMaxAge", 72*time.Hour, "Order is considered stuck after this time (0 - never)")
+	pRetryMaxAttempts := flag.Int("retryMaxAttempts", 0, "Order is considered stuck after this number of polls (0 - never)")
+	pAccrualRPS := flag.Float64("accrualRPS", 10, "Accrual system requests per second limit")
+	pBreakerThreshold := flag.Int("breakerThreshold", 5, "Accrual requests are stopped after this number of consecutive failures")
+	pBreakerOpenTimeout := flag.Duration("breakerOpen", 30*time.Second, "Pause of accrual requests before probe request")
+	pPointsTTLMonths := flag.Int("pointsTTL", 0, "Accrued points expire after this number of months (0 - never)")
+	pTiers := flag.String("tiers", "", "Loyalty tiers (name:threshold:multiplier,...), e.g. bronze:0:1,silver:1000:1.1,gold:5000:1.25")
+	pTransferDailyLimit := flag.Float64("transferDailyLimit", 0, "Points, which user can transfer to others within 24 hours (0 - unlimited)")
+	pReferrerBonus := flag.Float64("referrerBonus", 0, "Referral bonus of referrer for first processed order of referee (0 - none)")
+	pRefereeBonus := flag.Float64("refereeBonus", 0, "Referral bonus of referee for first processed order of referee (0 - none)")
+	pReferralMax := flag.Int("referralMax", 20, "Max number of users referred by one user (0 - unlimited)")
+	pBatchOrdersMax := flag.Int("batchOrdersMax", 100, "Max number of orders in batch upload (0 - unlimited)")
+	pWebhookMaxAttempts := flag.Int("webhookMaxAttempts", 10, "Webhook delivery is failed after this number of attempts (0 - never)")
+	pClawbackPolicy := flag.String("clawbackPolicy", ClawbackReject, "Clawback policy on not enough balance: reject, debt or partial")
+	pAdminToken := flag.String("adminToken", "", "Admin API bearer token")
+	pMerchantTokens := flag.String("merchantTokens", "", "Merchant API bearer tokens (name1:token1,name2:token2)")
 	flag.Parse()
 
 	if val, ok := os.LookupEnv("DATABASE_URI"); ok {
@@ -32,12 +125,154 @@ func New() Config {
 	if val, ok := os.LookupEnv("ACCRUAL_SYSTEM_ADDRESS"); ok {
 		pAccrualAddress = &val
 	}
+	if val, ok := os.LookupEnv("JWT_KEYS"); ok {
+		pJWTKeys = &val
+	}
+	if val, ok := os.LookupEnv("JWT_KEY_FILE"); ok {
+		pJWTKeyFile = &val
+	}
+	if val, ok := os.LookupEnv("POINTS_TTL_MONTHS"); ok {
+		if months, err := strconv.Atoi(val); err == nil {
+			pPointsTTLMonths = &months
+		}
+	}
+	if val, ok := os.LookupEnv("TIERS"); ok {
+		pTiers = &val
+	}
+	if val, ok := os.LookupEnv("TRANSFER_DAILY_LIMIT"); ok {
+		if limit, err := strconv.ParseFloat(val, 64); err == nil {
+			pTransferDailyLimit = &limit
+		}
+	}
+	if val, ok := os.LookupEnv("REFERRER_BONUS"); ok {
+		if bonus, err := strconv.ParseFloat(val, 64); err == nil {
+			pReferrerBonus = &bonus
+		}
+	}
+	if val, ok := os.LookupEnv("REFEREE_BONUS"); ok {
+		if bonus, err := strconv.ParseFloat(val, 64); err == nil {
+			pRefereeBonus = &bonus
+		}
+	}
+	if val, ok := os.LookupEnv("REFERRAL_MAX"); ok {
+		if limit, err := strconv.Atoi(val); err == nil {
+			pReferralMax = &limit
+		}
+	}
+	if val, ok := os.LookupEnv("BATCH_ORDERS_MAX"); ok {
+		if limit, err := strconv.Atoi(val); err == nil {
+			pBatchOrdersMax = &limit
+		}
+	}
+	if val, ok := os.LookupEnv("WEBHOOK_MAX_ATTEMPTS"); ok {
+		if attempts, err := strconv.Atoi(val); err == nil {
+			pWebhookMaxAttempts = &attempts
+		}
+	}
+	if val, ok := os.LookupEnv("CLAWBACK_POLICY"); ok {
+		pClawbackPolicy = &val
+	}
+	if val, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		pAdminToken = &val
+	}
+	if val, ok := os.LookupEnv("MERCHANT_TOKENS"); ok {
+		pMerchantTokens = &val
+	}
 
 	res.AutoInitPeriod = 15 * time.Second
 	res.ConnString = *pConnString
 	res.Endpoint = *pEndpoint
 	res.AccrualAddress = *pAccrualAddress
 	res.UseLuhn = *pUseLuhn
+	res.JWTKeys = *pJWTKeys
+	res.JWTKeyFile = *pJWTKeyFile
+	res.KeyReloadPeriod = time.Minute
+	res.SessionCacheTTL = 30 * time.Second
+	res.IdempotencyKeyTTL = 24 * time.Hour
+	res.HoldTTL = 15 * time.Minute
+	res.HoldMaxTTL = 24 * time.Hour
+	res.HoldExpirePeriod = 30 * time.Second
+	res.AccrualTimeout = 10 * time.Second
+	res.RetryBaseDelay = *pRetryBaseDelay
+	res.RetryMaxDelay = *pRetryMaxDelay
+	res.RetryJitter = *pRetryJitter
+	res.RetryMaxAge = *pRetryMaxAge
+	res.RetryMaxAttempts = *pRetryMaxAttempts
+	res.AccrualRPS = *pAccrualRPS
+	res.BreakerThreshold = *pBreakerThreshold
+	res.BreakerOpenTimeout = *pBreakerOpenTimeout
+	res.PointsTTLMonths = *pPointsTTLMonths
+	res.ExpiringSoonWindow = 30 * 24 * time.Hour
+	res.PointsExpirePeriod = time.Hour
+	res.UserEventsTTL = 24 * time.Hour
+	res.UserEventsPurgePeriod = time.Hour
+	res.UserEventsReconnect = 5 * time.Second
+	res.UserEventsHeartbeat = 15 * time.Second
+	tiers, err := parseTiers(*pTiers)
+	if err != nil {
+		return res, fmt.Errorf("invalid TIERS: %w", err)
+	}
+	res.Tiers = tiers
+	res.ClawbackPolicy = *pClawbackPolicy
+	res.BatchOrdersMax = *pBatchOrdersMax
+	res.WebhookPollPeriod = 2 * time.Second
+	res.WebhookTimeout = 10 * time.Second
+	res.WebhookRetryBase = 10 * time.Second
+	res.WebhookRetryMax = time.Hour
+	res.WebhookMaxAttempts = *pWebhookMaxAttempts
+	res.WebhookEventsTTL = 7 * 24 * time.Hour
+	res.TransferDailyLimit = int64(*pTransferDailyLimit*100 + 0.5)
+	res.ReferrerBonus = int64(*pReferrerBonus*100 + 0.5)
+	res.RefereeBonus = int64(*pRefereeBonus*100 + 0.5)
+	res.ReferralMaxPerUser = *pReferralMax
+	res.AdminToken = *pAdminToken
+	res.MerchantTokens = parseMerchantTokens(*pMerchantTokens)
+
+	return res, nil
+}
 
+// parseMerchantTokens parses "name1:token1,name2:token2"
+func parseMerchantTokens(val string) map[string]string {
+	res := make(map[string]string)
+	for _, v := range strings.Split(val, ",") {
+		name, token, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok || name == "" || token == "" {
+			continue
+		}
+		res[token] = name
+	}
 	return res
 }
+
+// parseTiers parses "name1:threshold1:multiplier1,name2:threshold2:multiplier2", threshold is in points.
+// Empty value disables tiers, any invalid tier is an error.
+func parseTiers(val string) ([]Tier, error) {
+	res := make([]Tier, 0)
+	if strings.TrimSpace(val) == "" {
+		return res, nil
+	}
+	for _, v := range strings.Split(val, ",") {
+		v = strings.TrimSpace(v)
+		parts := strings.Split(v, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("tier %q: expected name:threshold:multiplier", v)
+		}
+		threshold, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || threshold < 0 {
+			return nil, fmt.Errorf("tier %q: threshold must be a non-negative number", v)
+		}
+		multiplier, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || multiplier < 1 {
+			return nil, fmt.Errorf("tier %q: multiplier must be a number not less than 1", v)
+		}
+		res = append(res, Tier{Name: parts[0], Threshold: int64(threshold*100 + 0.5), Multiplier: multiplier})
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Threshold < res[j].Threshold })
+	// Progress to next tier is divided by difference of thresholds
+	for i := 1; i < len(res); i++ {
+		if res[i].Threshold == res[i-1].Threshold {
+			return nil, fmt.Errorf("tiers %q and %q have the same threshold", res[i-1].Name, res[i].Name)
+		}
+	}
+	return res, nil
+}
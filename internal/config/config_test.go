@@ -0,0 +1,34 @@
+package config
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := parseTiers("gold:5000:1.25, bronze:0:1,silver:1000.5:1.1")
+	require.NoError(t, err)
+	assert.Equal(t, []Tier{
+		{Name: "bronze", Threshold: 0, Multiplier: 1},
+		{Name: "silver", Threshold: 100050, Multiplier: 1.1},
+		{Name: "gold", Threshold: 500000, Multiplier: 1.25},
+	}, tiers)
+
+	tiers, err = parseTiers("")
+	require.NoError(t, err)
+	assert.Empty(t, tiers, "Empty value disables tiers")
+
+	for _, val := range []string{
+		"bronze:0",
+		":0:1",
+		"bronze:0:1,",
+		"bronze:zero:1",
+		"bronze:-1:1",
+		"bronze:0:0.9",
+		"bronze:0:1,silver:0:1.1",
+	} {
+		_, err = parseTiers(val)
+		assert.Error(t, err, val)
+	}
+}
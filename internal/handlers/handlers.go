@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +12,9 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
+	"yapracticum-go-diploma-1/internal/accrualpoll"
 	"yapracticum-go-diploma-1/internal/config"
 	"yapracticum-go-diploma-1/internal/storage"
 	"yapracticum-go-diploma-1/internal/utils"
@@ -20,11 +24,13 @@ type Handlers struct {
 	Logger    *zap.Logger
 	DBStorage *storage.Storage
 	Cfg       config.Config
+	Breaker   *accrualpoll.CircuitBreaker
 }
 
 type UserRegisterStruct struct {
-	Login    string `json:"login"`
-	Password string `json:"password"`
+	Login        string `json:"login"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code,omitempty"` // Optional, on registration only
 }
 
 type WithdrawStruct struct {
@@ -36,15 +42,13 @@ func (h *Handlers) GetBalance(w http.ResponseWriter, r *http.Request) {
 	tokenID := r.Header.Get("LoggedUserId")
 	balance, err := h.DBStorage.GetBalance(r.Context(), tokenID)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		h.writeError(w, r, err)
 		return
 	}
 
 	mJSON, err := json.Marshal(balance)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -52,6 +56,47 @@ func (h *Handlers) GetBalance(w http.ResponseWriter, r *http.Request) {
 	w.Write(mJSON)
 }
 
+func (h *Handlers) GetTier(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	tier, err := h.DBStorage.GetTier(r.Context(), tokenID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	mJSON, err := json.Marshal(tier)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(mJSON)
+}
+
+func (h *Handlers) GetBalanceHistory(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	data, err := h.DBStorage.GetBalanceHistory(r.Context(), tokenID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(data.Entries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	marshalled, err := json.Marshal(data.Entries)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
 func (h *Handlers) UserRegister(w http.ResponseWriter, r *http.Request) {
 
 	bodyData := make([]byte, r.ContentLength)
@@ -65,19 +110,15 @@ func (h *Handlers) UserRegister(w http.ResponseWriter, r *http.Request) {
 	var jsonData UserRegisterStruct
 	err = json.Unmarshal(bodyData, &jsonData)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		h.Logger.Error(err.Error())
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
 		return
 	}
 
-	err = h.DBStorage.UserRegister(r.Context(), jsonData.Login, jsonData.Password)
+	err = h.DBStorage.UserRegisterReferred(r.Context(), jsonData.Login, jsonData.Password, jsonData.ReferralCode)
 	if err != nil {
 		h.Logger.Error(err.Error())
-		if errors.Is(err, storage.ErrUserAlreadyExists) {
-			w.WriteHeader(http.StatusConflict)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-		}
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -93,29 +134,82 @@ func (h *Handlers) UserLogin(w http.ResponseWriter, r *http.Request) {
 	var jsonData UserRegisterStruct
 	err := json.Unmarshal(bodyData, &jsonData)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
 		h.Logger.Error(err.Error())
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
 		return
 	}
 
-	token, err := h.DBStorage.UserLogin(r.Context(), jsonData.Login, jsonData.Password)
+	tokens, err := h.DBStorage.UserLogin(r.Context(), jsonData.Login, jsonData.Password)
 	if err != nil {
-		if errors.Is(err, storage.ErrUserAuthFailed) {
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-		}
-		h.Logger.Error(err.Error())
+		h.writeError(w, r, err)
 		return
 	}
 
+	setSessionCookies(w, tokens)
+	w.WriteHeader(http.StatusOK)
+
+}
+
+func setSessionCookies(w http.ResponseWriter, tokens storage.AuthTokens) {
 	http.SetCookie(w, &http.Cookie{
 		Name:    "session_token",
-		Value:   token,
+		Value:   tokens.Access,
 		Expires: time.Now().Add(utils.TokenExp).Add(time.Hour), // Cookie expires a hour after token
 	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    tokens.Refresh,
+		Path:     "/api/user/token",
+		Expires:  time.Now().Add(utils.RefreshTokenExp),
+		HttpOnly: true,
+	})
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: "session_token", Value: "", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "refresh_token", Value: "", Path: "/api/user/token", MaxAge: -1, HttpOnly: true})
+}
+
+func (h *Handlers) TokenRefresh(w http.ResponseWriter, r *http.Request) {
+	cRefresh, err := r.Cookie("refresh_token")
+	if err != nil {
+		writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "no refresh token")
+		return
+	}
+
+	tokens, err := h.DBStorage.UserRefresh(r.Context(), cRefresh.Value)
+	if err != nil {
+		h.Logger.Info(err.Error())
+		h.writeError(w, r, err)
+		return
+	}
+
+	setSessionCookies(w, tokens)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handlers) UserLogout(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.Header.Get("LoggedSessionID")
+	err := h.DBStorage.UserLogout(r.Context(), sessionID)
+	if err != nil && !errors.Is(err, storage.ErrSessionNotFound) {
+		h.writeError(w, r, err)
+		return
+	}
+
+	clearSessionCookies(w)
 	w.WriteHeader(http.StatusOK)
+}
 
+func (h *Handlers) UserLogoutAll(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("LoggedUserId")
+	err := h.DBStorage.UserLogoutAll(r.Context(), userID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handlers) OrderLoad(w http.ResponseWriter, r *http.Request) {
@@ -126,33 +220,93 @@ func (h *Handlers) OrderLoad(w http.ResponseWriter, r *http.Request) {
 
 	ordernum, err := strconv.ParseInt(string(bodyData), 10, 64)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, codeOrderNumberInvalid, "order number is not a number")
 		return
 	}
 
 	err = h.DBStorage.OrderAddNew(r.Context(), tokenID, strconv.Itoa(int(ordernum)))
 	if err != nil {
-
-		if errors.Is(err, storage.ErrOrderOtherUser) {
-			w.WriteHeader(http.StatusConflict)
-			return
-		}
-
 		if errors.Is(err, storage.ErrOrderAlreadyExists) {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
+		h.writeError(w, r, err)
+		return
+	}
 
-		if errors.Is(err, storage.ErrOrderLuhnCheckFailed) {
-			w.WriteHeader(http.StatusUnprocessableEntity)
-			return
-		}
+	w.WriteHeader(http.StatusAccepted)
+}
 
-		w.WriteHeader(http.StatusBadRequest)
+// OrderLoadBatch uploads JSON array or newline separated list of order numbers
+func (h *Handlers) OrderLoadBatch(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
+	orderNums, err := parseOrderBatch(r.Header.Get("Content-Type"), bodyData)
+	if err != nil || len(orderNums) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "expected non-empty list of order numbers")
+		return
+	}
+
+	results, err := h.DBStorage.OrderAddBatch(r.Context(), tokenID, orderNums)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(results)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	// As for single order: 202 if any order is accepted for processing
+	status := http.StatusOK
+	for _, res := range results {
+		if res.Status == storage.BatchOrderAccepted {
+			status = http.StatusAccepted
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(marshalled)
+}
+
+// parseOrderBatch reads order numbers from JSON array of strings or numbers, or from lines of text
+func parseOrderBatch(contentType string, body []byte) ([]string, error) {
+	if !strings.HasPrefix(contentType, "application/json") {
+		res := make([]string, 0)
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				res = append(res, line)
+			}
+		}
+		return res, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(items))
+	for _, item := range items {
+		var num string
+		if json.Unmarshal(item, &num) != nil {
+			var number json.Number
+			if err := json.Unmarshal(item, &number); err != nil {
+				return nil, err
+			}
+			num = number.String()
+		}
+		res = append(res, num)
+	}
+	return res, nil
 }
 
 func (h *Handlers) UserCheckLoggedInHandler(w http.ResponseWriter, r *http.Request) {
@@ -161,19 +315,25 @@ func (h *Handlers) UserCheckLoggedInHandler(w http.ResponseWriter, r *http.Reque
 		w.Write([]byte("No session cookie"))
 		return
 	}
-	login, err := h.DBStorage.UserCheckLoggedIn(cSession.Value)
+	session, err := h.DBStorage.UserCheckLoggedIn(r.Context(), cSession.Value)
 	if err != nil {
 		w.Write([]byte("Not logged in"))
 		return
 	}
-	w.Write([]byte(fmt.Sprintf("Logged userID: %s", login)))
+	w.Write([]byte(fmt.Sprintf("Logged userID: %s", session.UserID)))
 }
 
 func (h *Handlers) OrderGetList(w http.ResponseWriter, r *http.Request) {
 	tokenID := r.Header.Get("LoggedUserId")
-	data, err := h.DBStorage.GetOrdersData(r.Context(), tokenID)
+	query, err := parseListQuery(r)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	data, err := h.DBStorage.GetOrdersPage(r.Context(), tokenID, query)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -184,11 +344,11 @@ func (h *Handlers) OrderGetList(w http.ResponseWriter, r *http.Request) {
 
 	marshalled, err := json.Marshal(data.Orders)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.Logger.Sugar().Errorf(err.Error())
+		h.writeError(w, r, err)
 		return
 	}
 
+	setNextPage(w, r, data.NextCursor)
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(marshalled)
 }
@@ -201,8 +361,8 @@ func (h *Handlers) Withdraw(w http.ResponseWriter, r *http.Request) {
 
 	var parsedData WithdrawStruct
 	err := json.Unmarshal(bodyData, &parsedData)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if err != nil || parsedData.Sum == nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
 		return
 	}
 
@@ -212,26 +372,65 @@ func (h *Handlers) Withdraw(w http.ResponseWriter, r *http.Request) {
 	m := digRe.FindStringSubmatch(parsedData.Order)
 
 	if m == nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeProblem(w, r, http.StatusUnprocessableEntity, codeOrderNumberInvalid, "order number is not a number")
 		return
 	}
 
-	err = h.DBStorage.Withdraw(r.Context(), tokenID, parsedData.Order, *parsedData.Sum)
-	if err != nil {
-		if errors.Is(err, storage.ErrWithdrawNotEnough) {
-			w.WriteHeader(http.StatusPaymentRequired)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey == "" {
+		err = h.DBStorage.Withdraw(r.Context(), tokenID, parsedData.Order, *parsedData.Sum)
+		if err != nil {
+			h.writeError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusBadRequest)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if len(idempotencyKey) > 255 {
+		writeProblem(w, r, http.StatusBadRequest, codeIdempotencyKeyInvalid, "idempotency key is longer than 255 characters")
+		return
+	}
+	bodyHash := sha256.Sum256(bodyData)
+	key := storage.IdempotencyKey{Key: idempotencyKey, RequestHash: hex.EncodeToString(bodyHash[:])}
+	resp, replayed, err := h.DBStorage.WithdrawIdempotent(r.Context(), tokenID, key, parsedData.Order, *parsedData.Sum, withdrawResponse(r))
+	if err != nil {
+		h.writeError(w, r, err)
 		return
 	}
+
+	if replayed {
+		h.Logger.Sugar().Infof("Withdraw request replayed, idempotency key: %s", idempotencyKey)
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	if len(resp.Body) > 0 {
+		w.Header().Set("Content-Type", "application/problem+json")
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+}
+
+// withdrawResponse maps Withdraw result to response, which is stored for idempotent requests
+func withdrawResponse(r *http.Request) func(error) storage.StoredResponse {
+	return func(err error) storage.StoredResponse {
+		if err == nil {
+			return storage.StoredResponse{StatusCode: http.StatusOK}
+		}
+		return problemResponse(r, err)
+	}
 }
 
 func (h *Handlers) WithdrawGetList(w http.ResponseWriter, r *http.Request) {
 	tokenID := r.Header.Get("LoggedUserId")
-	data, err := h.DBStorage.GetWithdrawalsData(r.Context(), tokenID)
+	query, err := parseListQuery(r)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	data, err := h.DBStorage.GetWithdrawalsPage(r.Context(), tokenID, query)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		h.writeError(w, r, err)
 		return
 	}
 
@@ -242,11 +441,24 @@ func (h *Handlers) WithdrawGetList(w http.ResponseWriter, r *http.Request) {
 
 	marshalled, err := json.Marshal(data.Withdrawals)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		h.Logger.Sugar().Errorf(err.Error())
+		h.writeError(w, r, err)
+		return
+	}
+
+	setNextPage(w, r, data.NextCursor)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
+// writeJSON writes data as JSON response with given status code
+func (h *Handlers) writeJSON(w http.ResponseWriter, r *http.Request, statusCode int, data any) {
+	marshalled, err := json.Marshal(data)
+	if err != nil {
+		h.writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
 	w.Write(marshalled)
 }
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func (h *Handlers) AdminGetStuckOrders(w http.ResponseWriter, r *http.Request) {
+	jobs, err := h.DBStorage.GetStuckAccrualJobs(r.Context())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(jobs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	marshalled, err := json.Marshal(jobs)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
+func (h *Handlers) AdminRetryStuckOrder(w http.ResponseWriter, r *http.Request) {
+	orderNum := chi.URLParam(r, "number")
+	err := h.DBStorage.RetryStuckAccrualJob(r.Context(), orderNum)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoDataChanged) {
+			writeProblem(w, r, http.StatusNotFound, codeStuckOrderNotFound, "order is not stuck or does not exist")
+			return
+		}
+		h.writeError(w, r, err)
+		return
+	}
+
+	h.Logger.Sugar().Infof("Stuck order %s is scheduled for retry", orderNum)
+	w.WriteHeader(http.StatusAccepted)
+}
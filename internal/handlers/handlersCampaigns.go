@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func (h *Handlers) AdminGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	campaigns, err := h.DBStorage.GetCampaigns(r.Context())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(campaigns) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, campaigns)
+}
+
+func (h *Handlers) AdminGetCampaign(w http.ResponseWriter, r *http.Request) {
+	campaign, err := h.DBStorage.GetCampaign(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, campaign)
+}
+
+func (h *Handlers) AdminCreateCampaign(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := parseCampaign(w, r)
+	if !ok {
+		return
+	}
+	campaign, err := h.DBStorage.CreateCampaign(r.Context(), campaign)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, campaign)
+}
+
+func (h *Handlers) AdminUpdateCampaign(w http.ResponseWriter, r *http.Request) {
+	campaign, ok := parseCampaign(w, r)
+	if !ok {
+		return
+	}
+	campaign.ID = chi.URLParam(r, "id")
+	campaign, err := h.DBStorage.UpdateCampaign(r.Context(), campaign)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, campaign)
+}
+
+func (h *Handlers) AdminDeleteCampaign(w http.ResponseWriter, r *http.Request) {
+	if err := h.DBStorage.DeleteCampaign(r.Context(), chi.URLParam(r, "id")); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseCampaign(w http.ResponseWriter, r *http.Request) (storage.CampaignInfo, bool) {
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return storage.CampaignInfo{}, false
+	}
+
+	var campaign storage.CampaignInfo
+	if err = json.Unmarshal(bodyData, &campaign); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return storage.CampaignInfo{}, false
+	}
+	return campaign, true
+}
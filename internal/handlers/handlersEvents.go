@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+// OrderEvents streams changes of user orders and balance as Server-Sent Events. Client, which sends Last-Event-ID
+// (or lastEventId query parameter), gets stored events after it first.
+func (h *Handlers) OrderEvents(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "Last-Event-ID must be event id")
+			return
+		}
+		lastID = id
+	}
+
+	// Subscription goes first: event committed during replay is not lost, it is skipped by id if already sent
+	events, unsubscribe := h.DBStorage.SubscribeUserEvents(tokenID)
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.WriteString(w, "retry: 3000\n\n"); err != nil {
+		return
+	}
+
+	if lastEventID != "" {
+		for {
+			stored, err := h.DBStorage.GetUserEvents(r.Context(), tokenID, lastID)
+			if err != nil {
+				h.Logger.Sugar().Errorf("Unable to replay user events: %s", err.Error())
+				return
+			}
+			for _, e := range stored {
+				if err = writeUserEvent(w, e); err != nil {
+					return
+				}
+				lastID = e.ID
+			}
+			if len(stored) == 0 {
+				break
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		h.Logger.Sugar().Errorf("Event stream is not supported: %s", err.Error())
+		return
+	}
+
+	heartbeat := h.Cfg.UserEventsHeartbeat
+	if heartbeat <= 0 {
+		heartbeat = 15 * time.Second
+	}
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				// Stream fell behind or events connection was lost: client reconnects with Last-Event-ID
+				return
+			}
+			if e.ID <= lastID {
+				continue
+			}
+			if err := writeUserEvent(w, e); err != nil {
+				return
+			}
+			lastID = e.ID
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeUserEvent(w io.Writer, e storage.UserEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func TestWriteUserEvent(t *testing.T) {
+	buf := bytes.Buffer{}
+	e := storage.UserEvent{ID: 42, Type: storage.UserEventOrder, Data: json.RawMessage(`{"number":"12345678903","status":"PROCESSED"}`)}
+	require.NoError(t, writeUserEvent(&buf, e))
+	assert.Equal(t, "id: 42\nevent: order\ndata: {\"number\":\"12345678903\",\"status\":\"PROCESSED\"}\n\n", buf.String())
+}
+
+func TestGzipFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handler := GzipHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: first\n\n")
+		require.NoError(t, http.NewResponseController(w).Flush())
+
+		// Flushed part is readable before response is finished
+		gr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+		require.NoError(t, err)
+		part := make([]byte, 64)
+		n, _ := gr.Read(part)
+		assert.Equal(t, "data: first\n\n", string(part[:n]))
+		assert.True(t, rec.Flushed)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/accrualpoll"
+)
+
+type HealthStruct struct {
+	Status  string                     `json:"status"`
+	Accrual *accrualpoll.BreakerStatus `json:"accrual,omitempty"`
+}
+
+// Health reports service status. Unavailable accrual system doesn't make the service unhealthy:
+// orders are accepted and polled after recovery, so status is "degraded" with 200 code.
+func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
+	res := HealthStruct{Status: "ok"}
+	if h.Breaker != nil {
+		status := h.Breaker.Status()
+		res.Accrual = &status
+		if h.Breaker.State() != accrualpoll.BreakerClosed {
+			res.Status = "degraded"
+		}
+	}
+
+	marshalled, err := json.Marshal(res)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
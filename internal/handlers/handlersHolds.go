@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+type HoldStruct struct {
+	Order string           `json:"order"`
+	Sum   *storage.Numeric `json:"sum"`
+	TTL   int64            `json:"ttl"` // Hold lifetime in seconds (0 - default)
+}
+
+func (h *Handlers) HoldCreate(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	var parsedData HoldStruct
+	if err = json.Unmarshal(bodyData, &parsedData); err != nil || parsedData.Sum == nil || *parsedData.Sum <= 0 || parsedData.TTL < 0 {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	ttl := time.Duration(parsedData.TTL) * time.Second
+	if ttl == 0 {
+		ttl = h.Cfg.HoldTTL
+	}
+	if h.Cfg.HoldMaxTTL > 0 && ttl > h.Cfg.HoldMaxTTL {
+		ttl = h.Cfg.HoldMaxTTL
+	}
+
+	hold, err := h.DBStorage.CreateHold(r.Context(), tokenID, parsedData.Order, *parsedData.Sum, ttl)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(hold)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(marshalled)
+}
+
+func (h *Handlers) HoldCapture(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	err := h.DBStorage.CaptureHold(r.Context(), tokenID, chi.URLParam(r, "id"))
+	h.holdFinished(w, r, err)
+}
+
+func (h *Handlers) HoldVoid(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	err := h.DBStorage.VoidHold(r.Context(), tokenID, chi.URLParam(r, "id"))
+	h.holdFinished(w, r, err)
+}
+
+func (h *Handlers) holdFinished(w http.ResponseWriter, r *http.Request, err error) {
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
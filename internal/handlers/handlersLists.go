@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+// parseListQuery reads page of list from query: limit, cursor, status (repeated or comma separated),
+// from and to (RFC3339), sort and order (asc or desc)
+func parseListQuery(r *http.Request) (storage.ListQuery, error) {
+	values := r.URL.Query()
+	q := storage.ListQuery{Cursor: values.Get("cursor"), SortBy: values.Get("sort")}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, fmt.Errorf("limit must be from 1 to %d: %w", storage.MaxListLimit, storage.ErrListQueryInvalid)
+		}
+		q.Limit = n
+	}
+
+	for _, status := range values["status"] {
+		for _, s := range strings.Split(status, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				q.Statuses = append(q.Statuses, s)
+			}
+		}
+	}
+
+	var err error
+	if q.From, err = parseListTime(values.Get("from"), "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseListTime(values.Get("to"), "to"); err != nil {
+		return q, err
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("order must be asc or desc: %w", storage.ErrListQueryInvalid)
+	}
+	return q, nil
+}
+
+func parseListTime(value string, name string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be RFC3339 time: %w", name, storage.ErrListQueryInvalid)
+	}
+	return t, nil
+}
+
+// setNextPage adds link to next page of list with the same query
+func setNextPage(w http.ResponseWriter, r *http.Request, cursor string) {
+	if cursor == "" {
+		return
+	}
+	values := r.URL.Query()
+	values.Set("cursor", cursor)
+	w.Header().Set("X-Next-Cursor", cursor)
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, values.Encode()))
+}
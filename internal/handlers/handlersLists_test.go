@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		want    storage.ListQuery
+		wantErr bool
+	}{
+		{name: "Empty", target: "/api/user/orders", want: storage.ListQuery{}},
+		{
+			name:   "Full",
+			target: "/api/user/orders?limit=10&cursor=abc&status=NEW,PROCESSING&status=INVALID&from=2024-01-01T00:00:00Z&sort=processed_at&order=desc",
+			want: storage.ListQuery{
+				Limit:    10,
+				Cursor:   "abc",
+				Statuses: []string{"NEW", "PROCESSING", "INVALID"},
+				From:     time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+				SortBy:   "processed_at",
+				Desc:     true,
+			},
+		},
+		{name: "Zero limit", target: "/api/user/orders?limit=0", wantErr: true},
+		{name: "Bad time", target: "/api/user/orders?to=yesterday", wantErr: true},
+		{name: "Bad order", target: "/api/user/orders?order=up", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseListQuery(httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, storage.ErrListQueryInvalid)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, q)
+		})
+	}
+}
+
+func TestSetNextPage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders?limit=2&cursor=old", nil)
+	rec := httptest.NewRecorder()
+	setNextPage(rec, req, "new")
+
+	assert.Equal(t, "new", rec.Header().Get("X-Next-Cursor"))
+	assert.Equal(t, `</api/user/orders?cursor=new&limit=2>; rel="next"`, rec.Header().Get("Link"))
+
+	rec = httptest.NewRecorder()
+	setNextPage(rec, req, "")
+	assert.Empty(t, rec.Header().Get("Link"))
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+type ReversalStruct struct {
+	Sum    *storage.Numeric `json:"sum"` // Not set - full refund of remaining part
+	Reason string           `json:"reason"`
+}
+
+func (h *Handlers) WithdrawalReverse(w http.ResponseWriter, r *http.Request) {
+	orderNum := chi.URLParam(r, "number")
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	var parsedData ReversalStruct
+	if len(bodyData) > 0 {
+		if err = json.Unmarshal(bodyData, &parsedData); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+			return
+		}
+	}
+
+	reversal, err := h.DBStorage.ReverseWithdrawal(r.Context(), orderNum, parsedData.Sum, parsedData.Reason, r.Header.Get("LoggedActor"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(reversal)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
+type ClawbackStruct struct {
+	Sum    *storage.Numeric `json:"sum"` // Not set - whole remaining accrual of order
+	Reason string           `json:"reason"`
+}
+
+func (h *Handlers) OrderClawback(w http.ResponseWriter, r *http.Request) {
+	orderNum := chi.URLParam(r, "number")
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	var parsedData ClawbackStruct
+	if len(bodyData) > 0 {
+		if err = json.Unmarshal(bodyData, &parsedData); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+			return
+		}
+	}
+
+	adjustment, err := h.DBStorage.ClawbackAccrual(r.Context(), orderNum, parsedData.Sum, parsedData.Reason, r.Header.Get("LoggedActor"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(adjustment)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (h *Handlers) GetReferral(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	referral, err := h.DBStorage.GetReferral(r.Context(), tokenID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(referral)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
+func (h *Handlers) AdminGetReferrals(w http.ResponseWriter, r *http.Request) {
+	referrals, err := h.DBStorage.GetReferralsReport(r.Context())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(referrals) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	marshalled, err := json.Marshal(referrals)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
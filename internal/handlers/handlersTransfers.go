@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+type TransferStruct struct {
+	Login string           `json:"login"` // Recipient
+	Sum   *storage.Numeric `json:"sum"`
+}
+
+func (h *Handlers) Transfer(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	var parsedData TransferStruct
+	if err = json.Unmarshal(bodyData, &parsedData); err != nil || parsedData.Login == "" || parsedData.Sum == nil || *parsedData.Sum <= 0 {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	transfer, err := h.DBStorage.Transfer(r.Context(), tokenID, parsedData.Login, *parsedData.Sum)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	marshalled, err := json.Marshal(transfer)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
+
+func (h *Handlers) TransferGetList(w http.ResponseWriter, r *http.Request) {
+	tokenID := r.Header.Get("LoggedUserId")
+	transfers, err := h.DBStorage.GetTransfers(r.Context(), tokenID)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(transfers) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	marshalled, err := json.Marshal(transfers)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(marshalled)
+}
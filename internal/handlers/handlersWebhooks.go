@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func (h *Handlers) AdminGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := h.DBStorage.GetWebhooks(r.Context())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, webhooks)
+}
+
+// AdminCreateWebhook registers endpoint. Response contains secret of payload signature, it is not shown later.
+func (h *Handlers) AdminCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	bodyData, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	var webhook storage.WebhookInfo
+	if err = json.Unmarshal(bodyData, &webhook); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "")
+		return
+	}
+
+	webhook, err = h.DBStorage.CreateWebhook(r.Context(), webhook)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeJSON(w, r, http.StatusCreated, webhook)
+}
+
+func (h *Handlers) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	if err := h.DBStorage.DeleteWebhook(r.Context(), chi.URLParam(r, "id")); err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handlers) AdminGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	deliveries, err := h.DBStorage.GetWebhookDeliveries(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, deliveries)
+}
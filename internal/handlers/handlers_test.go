@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseOrderBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []string
+		wantErr     bool
+	}{
+		{name: "JSON strings and numbers", contentType: "application/json", body: `["12345678903", 79927398713, "abc"]`, want: []string{"12345678903", "79927398713", "abc"}},
+		{name: "Text lines", contentType: "text/plain", body: "12345678903\r\n\n 79927398713 \n", want: []string{"12345678903", "79927398713"}},
+		{name: "Not an array", contentType: "application/json; charset=utf-8", body: `{"order": "12345678903"}`, wantErr: true},
+		{name: "Nested object", contentType: "application/json", body: `[{"order": "12345678903"}]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOrderBatch(tt.contentType, []byte(tt.body))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
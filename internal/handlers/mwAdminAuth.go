@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// AdminAuth allows request only with "Authorization: Bearer <AdminToken>". Admin API is disabled, if token is not configured.
+func (h *Handlers) AdminAuth(hand http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Cfg.AdminToken == "" {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, "")
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Cfg.AdminToken)) != 1 {
+			h.Logger.Sugar().Warnf("Admin API access denied: %s %s", r.Method, r.RequestURI)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "")
+			return
+		}
+
+		hand.ServeHTTP(w, r)
+	})
+}
@@ -3,21 +3,22 @@ package handlers
 import (
 	"net/http"
 	"strings"
+	"yapracticum-go-diploma-1/internal/storage"
 )
 
-func (h *Handlers) userCheckLoggedIn(w http.ResponseWriter, r *http.Request) (string, bool) {
+func (h *Handlers) userCheckLoggedIn(w http.ResponseWriter, r *http.Request) (storage.UserSession, bool) {
 	cSession, err := r.Cookie("session_token")
 	if err != nil {
 		h.Logger.Info(err.Error())
-		return "", false
+		return storage.UserSession{}, false
 	}
-	userID, err := h.DBStorage.UserCheckLoggedIn(cSession.Value)
+	session, err := h.DBStorage.UserCheckLoggedIn(r.Context(), cSession.Value)
 	if err != nil {
 		h.Logger.Info(err.Error())
-		return "", false
+		return storage.UserSession{}, false
 	}
 
-	return userID, true
+	return session, true
 }
 
 func (h *Handlers) CustomAuth(exclude ...string) func(http.Handler) http.Handler {
@@ -30,12 +31,13 @@ func (h *Handlers) CustomAuth(exclude ...string) func(http.Handler) http.Handler
 				}
 			}
 
-			userID, loggedIn := h.userCheckLoggedIn(w, r)
+			session, loggedIn := h.userCheckLoggedIn(w, r)
 			if !loggedIn {
-				w.WriteHeader(http.StatusUnauthorized)
+				writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "")
 				return
 			}
-			r.Header.Set("LoggedUserID", userID)
+			r.Header.Set("LoggedUserID", session.UserID)
+			r.Header.Set("LoggedSessionID", session.SessionID)
 
 			hand.ServeHTTP(w, r)
 		})
@@ -17,6 +17,14 @@ func (gzw gzipResponseWriter) Write(b []byte) (int, error) {
 	return gzw.w.Write(b)
 }
 
+// Flush sends compressed data written so far, it is required by event stream
+func (gzw gzipResponseWriter) Flush() {
+	gzw.w.Flush()
+	if f, ok := gzw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (gzw gzipResponseWriter) Close() error {
 	return gzw.w.Close()
 }
@@ -32,11 +40,14 @@ func GzipHandler(h http.Handler) http.Handler {
 		encodedGzip := strings.Contains(r.Header.Get("Content-Encoding"), "gzip")
 
 		if encodedGzip {
-			gr, _ := gzip.NewReader(r.Body)
 			bodyData := bytes.Buffer{}
-			_, err := bodyData.ReadFrom(gr)
+			gr, err := gzip.NewReader(r.Body)
+			if err == nil {
+				_, err = bodyData.ReadFrom(gr)
+			}
 			if err != nil {
-				http.Error(w, "GZIP decompression error", 500)
+				writeProblem(w, r, http.StatusBadRequest, codeMalformedRequest, "gzip decompression error")
+				return
 			}
 			r.Body = io.NopCloser(bytes.NewReader(bodyData.Bytes()))
 			r.ContentLength = int64(len(bodyData.Bytes()))
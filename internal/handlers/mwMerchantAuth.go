@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// MerchantAuth allows request with admin token or one of merchant tokens. Name of authenticated party
+// ("admin" or "merchant:<name>") is passed to handlers in LoggedActor header.
+func (h *Handlers) MerchantAuth(hand http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.Cfg.AdminToken == "" && len(h.Cfg.MerchantTokens) == 0 {
+			writeProblem(w, r, http.StatusNotFound, codeNotFound, "")
+			return
+		}
+
+		actor := ""
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && token != "" {
+			if h.Cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.Cfg.AdminToken)) == 1 {
+				actor = "admin"
+			}
+			for merchantToken, name := range h.Cfg.MerchantTokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(merchantToken)) == 1 {
+					actor = "merchant:" + name
+				}
+			}
+		}
+		if actor == "" {
+			h.Logger.Sugar().Warnf("Merchant API access denied: %s %s", r.Method, r.RequestURI)
+			writeProblem(w, r, http.StatusUnauthorized, codeUnauthorized, "")
+			return
+		}
+
+		r.Header.Set("LoggedActor", actor)
+		hand.ServeHTTP(w, r)
+	})
+}
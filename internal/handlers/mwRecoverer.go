@@ -8,11 +8,13 @@ func (h *Handlers) Recoverer(hand http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				h.Logger.Sugar().Errorf("500: %v", err)
-				return
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				h.Logger.Sugar().Errorf("500 (%s): %v", requestID(r.Context()), err)
+				writeProblem(w, r, http.StatusInternalServerError, codeInternal, "")
 			}
-			hand.ServeHTTP(w, r)
 		}()
+		hand.ServeHTTP(w, r)
 	})
 }
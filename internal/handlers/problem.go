@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+//////////////////////////
+// RFC 7807 error responses
+//////////////////////////
+
+// Problem codes: stable machine-readable part of error response
+const (
+	codeMalformedRequest      = "malformed_request"
+	codeOrderNumberInvalid    = "order_number_invalid" // Not a number
+	codeIdempotencyKeyInvalid = "idempotency_key_invalid"
+	codeUnauthorized          = "unauthorized"
+	codeNotFound              = "not_found"
+	codeMethodNotAllowed      = "method_not_allowed"
+	codeStuckOrderNotFound    = "stuck_order_not_found"
+	codeInternal              = "internal_error"
+)
+
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"` // Request path
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// storageProblems maps storage errors to response status and code. Detail is the text of storage error
+// (not the wrapped one, which may contain SQL details), unless verbose is set.
+var storageProblems = []struct {
+	err     error
+	status  int
+	code    string
+	verbose bool
+}{
+	{err: storage.ErrUserAlreadyExists, status: http.StatusConflict, code: "login_taken"},
+	{err: storage.ErrUserDataInvalid, status: http.StatusBadRequest, code: codeMalformedRequest},
+	{err: storage.ErrUserAuthFailed, status: http.StatusUnauthorized, code: "auth_failed"},
+	{err: storage.ErrUserNotLoggedIn, status: http.StatusUnauthorized, code: codeUnauthorized},
+	{err: storage.ErrSessionNotFound, status: http.StatusUnauthorized, code: "session_not_found"},
+	{err: storage.ErrOrderOtherUser, status: http.StatusConflict, code: "order_other_user"},
+	{err: storage.ErrOrderLuhnCheckFailed, status: http.StatusUnprocessableEntity, code: "order_luhn_failed"},
+	{err: storage.ErrOrderNotFound, status: http.StatusNotFound, code: "order_not_found"},
+	{err: storage.ErrWithdrawNotEnough, status: http.StatusPaymentRequired, code: "insufficient_points"},
+	{err: storage.ErrWithdrawalAlreadyExists, status: http.StatusConflict, code: "order_already_paid"},
+	{err: storage.ErrWithdrawalNotFound, status: http.StatusNotFound, code: "withdrawal_not_found"},
+	{err: storage.ErrReversalExceedsWithdrawal, status: http.StatusUnprocessableEntity, code: "reversal_exceeds_withdrawal"},
+	{err: storage.ErrClawbackExceedsAccrual, status: http.StatusUnprocessableEntity, code: "clawback_exceeds_accrual"},
+	{err: storage.ErrClawbackNotEnough, status: http.StatusConflict, code: "clawback_insufficient_points"},
+	{err: storage.ErrHoldAlreadyExists, status: http.StatusConflict, code: "hold_already_exists"},
+	{err: storage.ErrHoldNotFound, status: http.StatusNotFound, code: "hold_not_found"},
+	{err: storage.ErrHoldNotActive, status: http.StatusConflict, code: "hold_not_active"},
+	{err: storage.ErrIdempotencyKeyReused, status: http.StatusUnprocessableEntity, code: "idempotency_key_reused"},
+	{err: storage.ErrTiersDisabled, status: http.StatusNotFound, code: "tiers_disabled"},
+	{err: storage.ErrTransferRecipientNotFound, status: http.StatusNotFound, code: "recipient_not_found"},
+	{err: storage.ErrTransferToSelf, status: http.StatusUnprocessableEntity, code: "transfer_to_self"},
+	{err: storage.ErrTransferLimitExceeded, status: http.StatusUnprocessableEntity, code: "transfer_limit_exceeded"},
+	{err: storage.ErrReferralCodeNotFound, status: http.StatusUnprocessableEntity, code: "referral_code_not_found"},
+	{err: storage.ErrReferralLimitExceeded, status: http.StatusUnprocessableEntity, code: "referral_limit_exceeded"},
+	{err: storage.ErrCampaignNotFound, status: http.StatusNotFound, code: "campaign_not_found"},
+	{err: storage.ErrCampaignInvalid, status: http.StatusUnprocessableEntity, code: "campaign_invalid", verbose: true},
+	{err: storage.ErrWebhookNotFound, status: http.StatusNotFound, code: "webhook_not_found"},
+	{err: storage.ErrWebhookInvalid, status: http.StatusUnprocessableEntity, code: "webhook_invalid", verbose: true},
+	{err: storage.ErrBatchTooLarge, status: http.StatusRequestEntityTooLarge, code: "batch_too_large", verbose: true},
+	{err: storage.ErrListQueryInvalid, status: http.StatusBadRequest, code: "list_query_invalid", verbose: true},
+}
+
+// problemFor returns status, code and detail of error. Unknown errors are internal, their text is not shown.
+func problemFor(err error) (int, string, string) {
+	for _, p := range storageProblems {
+		if errors.Is(err, p.err) {
+			if p.verbose {
+				return p.status, p.code, err.Error()
+			}
+			return p.status, p.code, p.err.Error()
+		}
+	}
+	return http.StatusInternalServerError, codeInternal, ""
+}
+
+func newProblem(r *http.Request, status int, code string, detail string) Problem {
+	return Problem{
+		Type:      "urn:gophermart:problem:" + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Code:      code,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: requestID(r.Context()),
+	}
+}
+
+func (p Problem) body() []byte {
+	res, _ := json.Marshal(p)
+	return res
+}
+
+// writeProblem is the only way handlers and middlewares answer with error
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(newProblem(r, status, code, detail).body())
+}
+
+// writeError answers with problem mapped from error. Internal errors are logged.
+func (h *Handlers) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code, detail := problemFor(err)
+	if status >= http.StatusInternalServerError {
+		h.Logger.Sugar().Errorf("Request %s %s (%s): %s", r.Method, r.URL.Path, requestID(r.Context()), err.Error())
+	}
+	writeProblem(w, r, status, code, detail)
+}
+
+// problemResponse maps error to response, which can be stored and replayed
+func problemResponse(r *http.Request, err error) storage.StoredResponse {
+	status, code, detail := problemFor(err)
+	return storage.StoredResponse{StatusCode: status, Body: newProblem(r, status, code, detail).body()}
+}
+
+func (h *Handlers) NotFound(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusNotFound, codeNotFound, "")
+}
+
+func (h *Handlers) MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "")
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"yapracticum-go-diploma-1/internal/storage"
+)
+
+func TestProblemFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+		wantDetail string
+	}{
+		{name: "Sentinel", err: storage.ErrOrderLuhnCheckFailed, wantStatus: http.StatusUnprocessableEntity, wantCode: "order_luhn_failed", wantDetail: storage.ErrOrderLuhnCheckFailed.Error()},
+		{name: "Wrapped SQL error is hidden", err: fmt.Errorf("ERROR: duplicate key (SQLSTATE 23505): %w", storage.ErrUserAlreadyExists), wantStatus: http.StatusConflict, wantCode: "login_taken", wantDetail: storage.ErrUserAlreadyExists.Error()},
+		{name: "Rejected by database", err: fmt.Errorf("ERROR: invalid byte sequence (SQLSTATE 22021): %w", storage.ErrUserDataInvalid), wantStatus: http.StatusBadRequest, wantCode: codeMalformedRequest, wantDetail: storage.ErrUserDataInvalid.Error()},
+		{name: "Verbose", err: fmt.Errorf("name is empty: %w", storage.ErrCampaignInvalid), wantStatus: http.StatusUnprocessableEntity, wantCode: "campaign_invalid", wantDetail: "name is empty: invalid campaign rule"},
+		{name: "Unknown", err: fmt.Errorf("connection refused"), wantStatus: http.StatusInternalServerError, wantCode: codeInternal, wantDetail: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code, detail := problemFor(tt.err)
+			assert.Equal(t, tt.wantStatus, status)
+			assert.Equal(t, tt.wantCode, code)
+			assert.Equal(t, tt.wantDetail, detail)
+		})
+	}
+}
+
+func TestRecoverer(t *testing.T) {
+	h := Handlers{Logger: zap.NewNop()}
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	handler := h.RequestID(h.Recoverer(panicking))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+	req.Header.Set("X-Request-Id", "test-request-1")
+	rec := httptest.NewRecorder()
+	require.NotPanics(t, func() { handler.ServeHTTP(rec, req) })
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "test-request-1", rec.Header().Get("X-Request-Id"))
+
+	var problem Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &problem))
+	assert.Equal(t, codeInternal, problem.Code)
+	assert.Equal(t, http.StatusInternalServerError, problem.Status)
+	assert.Equal(t, "/api/user/balance", problem.Instance)
+	assert.Equal(t, "test-request-1", problem.RequestID)
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	h := Handlers{Logger: zap.NewNop()}
+	var got string
+	handler := h.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = requestID(r.Context()) }))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Request-Id", "bad id with spaces")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Len(t, got, 32)
+	assert.Equal(t, got, rec.Header().Get("X-Request-Id"))
+}
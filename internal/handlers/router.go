@@ -7,28 +7,94 @@ import (
 
 func GophermartRouter(h Handlers) chi.Router {
 	router := chi.NewRouter()
+	// Recoverer is inside GzipHandler, so its error response is compressed as well
 	router.Use(
-		h.Recoverer,
+		h.RequestID,
 		GzipHandler,
-		h.CustomAuth("/api/user/register", "/api/user/login"))
+		h.Recoverer,
+		h.CustomAuth("/api/user/register", "/api/user/login", "/api/user/token/refresh", "/api/admin/", "/api/merchant/", "/api/health", "/metrics"))
 	// регистрация пользователя
 	router.Post("/api/user/register", h.UserRegister)
 	// аутентификация пользователя
 	router.Post("/api/user/login", h.UserLogin)
+	// обновление токена доступа по refresh-токену
+	router.Post("/api/user/token/refresh", h.TokenRefresh)
+	// завершение текущей сессии
+	router.Post("/api/user/logout", h.UserLogout)
+	// завершение всех сессий пользователя
+	router.Post("/api/user/logout-all", h.UserLogoutAll)
 	// загрузка пользователем номера заказа для расчёта
 	router.Post("/api/user/orders", h.OrderLoad)
-	// получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях
+	// пакетная загрузка номеров заказов (JSON-массив или по одному номеру в строке)
+	router.Post("/api/user/orders/batch", h.OrderLoadBatch)
+	// поток событий (SSE) об изменении статусов заказов и баланса
+	router.Get("/api/user/orders/events", h.OrderEvents)
+	// получение списка загруженных пользователем номеров заказов, статусов их обработки и информации о начислениях (постранично, с фильтрами и сортировкой)
 	router.Get("/api/user/orders", h.OrderGetList)
 	// получение текущего баланса счёта баллов лояльности пользователя
 	router.Get("/api/user/balance", h.GetBalance)
+	// история движения баллов с нарастающим итогом
+	router.Get("/api/user/balance/history", h.GetBalanceHistory)
+	// текущий уровень программы лояльности и прогресс до следующего
+	router.Get("/api/user/tier", h.GetTier)
+	// реферальный код пользователя и статистика приглашённых
+	router.Get("/api/user/referral", h.GetReferral)
 	// запрос на списание баллов с накопительного счёта в счёт оплаты нового заказа
 	router.Post("/api/user/balance/withdraw", h.Withdraw)
-	// получение информации о выводе средств с накопительного счёта пользователем
+	// перевод баллов другому пользователю по логину
+	router.Post("/api/user/balance/transfer", h.Transfer)
+	// отправленные и полученные переводы
+	router.Get("/api/user/balance/transfers", h.TransferGetList)
+	// резервирование баллов под заказ
+	router.Post("/api/user/balance/holds", h.HoldCreate)
+	// списание зарезервированных баллов
+	router.Post("/api/user/balance/holds/{id}/capture", h.HoldCapture)
+	// отмена резерва
+	router.Post("/api/user/balance/holds/{id}/void", h.HoldVoid)
+	// получение информации о выводе средств с накопительного счёта пользователем (постранично)
 	router.Get("/api/user/withdrawals", h.WithdrawGetList)
 
+	// Admin API
+	router.Route("/api/admin", func(r chi.Router) {
+		r.Use(h.AdminAuth)
+		// заказы, опрос которых прекращён политикой повторов
+		r.Get("/accrual/stuck", h.AdminGetStuckOrders)
+		// возобновление опроса заказа
+		r.Post("/accrual/stuck/{number}/retry", h.AdminRetryStuckOrder)
+		// промо-акции: правила начисления дополнительных баллов
+		r.Get("/campaigns", h.AdminGetCampaigns)
+		r.Post("/campaigns", h.AdminCreateCampaign)
+		r.Get("/campaigns/{id}", h.AdminGetCampaign)
+		r.Put("/campaigns/{id}", h.AdminUpdateCampaign)
+		r.Delete("/campaigns/{id}", h.AdminDeleteCampaign)
+		// отчёт: кто кого пригласил и какие бонусы начислены
+		r.Get("/referrals", h.AdminGetReferrals)
+		// webhooks: уведомления внешних систем о начислениях и списаниях
+		r.Get("/webhooks", h.AdminGetWebhooks)
+		r.Post("/webhooks", h.AdminCreateWebhook)
+		r.Delete("/webhooks/{id}", h.AdminDeleteWebhook)
+		// журнал доставки событий webhook
+		r.Get("/webhooks/{id}/deliveries", h.AdminGetWebhookDeliveries)
+	})
+
+	// состояние сервиса и доступность системы начислений
+	router.Get("/api/health", h.Health)
+
+	// Merchant API (также доступно с токеном администратора)
+	router.Route("/api/merchant", func(r chi.Router) {
+		r.Use(h.MerchantAuth)
+		// полный или частичный возврат баллов, списанных в счёт заказа
+		r.Post("/withdrawals/{number}/reverse", h.WithdrawalReverse)
+		// списание ранее начисленных за заказ баллов (заказ отменён или возвращён)
+		r.Post("/orders/{number}/clawback", h.OrderClawback)
+	})
+
 	// Prometheus
 	router.Get("/metrics", promhttp.Handler().ServeHTTP)
 
+	router.NotFound(h.NotFound)
+	router.MethodNotAllowed(h.MethodNotAllowed)
+
 	// Test
 	router.Get("/api/user/checklogged", h.UserCheckLoggedInHandler)
 
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"regexp"
@@ -15,22 +16,114 @@ type Storager interface {
 	setConfig(config config.Config)
 	getConfig() config.Config
 	UserRegister(context.Context, string, string) error
-	UserLogin(context.Context, string, string) (string, error)
-	UserCheckLoggedIn(string) (string, error)
+	UserRegisterReferred(context.Context, string, string, string) error
+	UserLogin(context.Context, string, string) (AuthTokens, error)
+	UserCheckLoggedIn(context.Context, string) (UserSession, error)
+	UserRefresh(context.Context, string) (AuthTokens, error)
+	UserLogout(context.Context, string) error
+	UserLogoutAll(context.Context, string) error
 	OrderAddNew(context.Context, string, string) error
+	OrderAddBatch(context.Context, string, []string) ([]BatchOrderResult, error)
 	GetOrdersData(context.Context, string) (OrdersInfo, error)
-	GetUnhandledOrders(context.Context) (OrdersInfo, error)
+	GetOrdersPage(context.Context, string, ListQuery) (OrdersInfo, error)
+	ClaimAccrualJobs(context.Context, string, string, int, time.Duration) ([]AccrualJob, error)
+	GetAccrualJobDue(context.Context, string) (time.Time, bool, error)
+	RescheduleAccrualJob(context.Context, string, time.Time, string) error
+	CompleteAccrualJob(context.Context, string) error
+	ListAccrualJobs(context.Context, time.Time) ([]AccrualJobDue, error)
+	MarkAccrualJobStuck(context.Context, string, string) error
+	GetStuckAccrualJobs(context.Context) ([]StuckAccrualJob, error)
+	RetryStuckAccrualJob(context.Context, string) error
 	Withdraw(context.Context, string, string, Numeric) error
+	WithdrawIdempotent(context.Context, string, IdempotencyKey, string, Numeric, func(error) StoredResponse) (StoredResponse, bool, error)
 	GetWithdrawalsData(context.Context, string) (WithdrawalsInfo, error)
+	GetWithdrawalsPage(context.Context, string, ListQuery) (WithdrawalsInfo, error)
+	ReverseWithdrawal(context.Context, string, *Numeric, string, string) (WithdrawalReversalInfo, error)
+	ClawbackAccrual(context.Context, string, *Numeric, string, string) (AccrualAdjustmentInfo, error)
+	CreateHold(context.Context, string, string, Numeric, time.Duration) (HoldInfo, error)
+	CaptureHold(context.Context, string, string) error
+	VoidHold(context.Context, string, string) error
+	ExpireHolds(context.Context) (int, error)
+	ExpirePoints(context.Context) (int, error)
+	SubscribeUserEvents(string) (<-chan UserEvent, func())
+	GetUserEvents(context.Context, string, int64) ([]UserEvent, error)
+	PurgeUserEvents(context.Context) (int, error)
+	CreateWebhook(context.Context, WebhookInfo) (WebhookInfo, error)
+	DeleteWebhook(context.Context, string) error
+	GetWebhooks(context.Context) ([]WebhookInfo, error)
+	GetWebhookDeliveries(context.Context, string) ([]WebhookDeliveryInfo, error)
+	DispatchWebhookEvents(context.Context) (int, error)
+	ClaimWebhookDeliveries(context.Context, int, time.Duration) ([]WebhookDelivery, error)
+	FinishWebhookAttempt(context.Context, int64, WebhookAttempt) error
+	PurgeWebhookEvents(context.Context, time.Duration) (int, error)
 	GetBalance(context.Context, string) (BalanceInfo, error)
+	GetBalanceHistory(context.Context, string) (LedgerInfo, error)
+	GetTier(context.Context, string) (TierInfo, error)
+	Transfer(context.Context, string, string, Numeric) (TransferInfo, error)
+	GetTransfers(context.Context, string) ([]TransferInfo, error)
+	GetReferral(context.Context, string) (ReferralInfo, error)
+	GetReferralsReport(context.Context) ([]ReferralReportInfo, error)
+	CreateCampaign(context.Context, CampaignInfo) (CampaignInfo, error)
+	UpdateCampaign(context.Context, CampaignInfo) (CampaignInfo, error)
+	DeleteCampaign(context.Context, string) error
+	GetCampaign(context.Context, string) (CampaignInfo, error)
+	GetCampaigns(context.Context) ([]CampaignInfo, error)
+	VerifyLedger(context.Context) ([]string, error)
 	ApplyAccrualResponse(context.Context, AccrualResponse) error
 	Close(ctx context.Context)
 }
 
-type OrderTag struct {
+// AccrualJob: order claimed by accrual poll worker
+type AccrualJob struct {
 	OrderNum  string
-	PollAfter time.Time
-	IssuedAt  time.Time
+	Attempts  int // Including current one
+	LastError string
+	CreatedAt time.Time
+	Since     time.Time // Start of current retry series
+}
+
+type StuckAccrualJob struct {
+	Order     string      `json:"order"`
+	UserID    string      `json:"user_id"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error,omitempty"`
+	CreatedAt RFC3339Time `json:"created_at"`
+	StuckAt   RFC3339Time `json:"stuck_at"`
+}
+
+type AccrualJobDue struct {
+	OrderNum string
+	Due      time.Time
+}
+
+//////////////////////////
+// Idempotency
+//////////////////////////
+
+// IdempotencyKey: client supplied key and hash of request body
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+}
+
+// StoredResponse: response of idempotent request, replayed on retry
+type StoredResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+//////////////////////////
+// Sessions
+//////////////////////////
+
+type AuthTokens struct {
+	Access  string
+	Refresh string
+}
+
+type UserSession struct {
+	UserID    string
+	SessionID string
 }
 
 //////////////////////////
@@ -40,6 +133,10 @@ type OrderTag struct {
 type Numeric int64
 
 func (n *Numeric) String() string {
+	if *n < 0 {
+		abs := -*n
+		return "-" + abs.String()
+	}
 	return fmt.Sprintf("%d.%02d", *n/100, *n%100)
 }
 
@@ -83,18 +180,260 @@ type AccrualResponse struct {
 //////////////////////////
 
 type BalanceInfo struct {
-	Current   *Numeric `json:"current"`
+	Current   *Numeric `json:"current"` // Available points: balance minus held
 	Withdrawn *Numeric `json:"withdrawn"`
+	Held      *Numeric `json:"held"`
+	Debt      *Numeric `json:"debt,omitempty"` // Clawback debt, repaid from next accruals
+
+	ExpiringSoon []ExpiringPointsInfo `json:"expiring_soon,omitempty"`
+}
+
+type ExpiringPointsInfo struct {
+	Amount    *Numeric    `json:"amount"`
+	ExpiresAt RFC3339Time `json:"expires_at"`
+}
+
+type HoldInfo struct {
+	ID        string      `json:"id"`
+	Order     string      `json:"order"`
+	Sum       *Numeric    `json:"sum"`
+	Status    string      `json:"status"`
+	CreatedAt RFC3339Time `json:"created_at"`
+	ExpiresAt RFC3339Time `json:"expires_at"`
 }
 
 type WithdrawalInfo struct {
+	id          string
 	Order       string      `json:"order"`
 	Sum         *Numeric    `json:"sum"`
 	ProcessedAt RFC3339Time `json:"processed_at"`
+	Status      string      `json:"status"`
+	Reversed    *Numeric    `json:"reversed,omitempty"`
+}
+
+type WithdrawalReversalInfo struct {
+	Order     string      `json:"order"`
+	Sum       *Numeric    `json:"sum"`      // Refunded by this reversal
+	Reversed  *Numeric    `json:"reversed"` // Refunded in total
+	Status    string      `json:"status"`
+	CreatedAt RFC3339Time `json:"created_at"`
 }
 
 type WithdrawalsInfo struct {
 	Withdrawals []WithdrawalInfo
+	NextCursor  string // Empty on last page
+}
+
+type TransferInfo struct {
+	ID           string      `json:"id"`
+	Direction    string      `json:"direction"`    // "out" - sent by user, "in" - received
+	Counterparty string      `json:"counterparty"` // Login of the other user
+	Sum          *Numeric    `json:"sum"`
+	CreatedAt    RFC3339Time `json:"created_at"`
+}
+
+type AccrualAdjustmentInfo struct {
+	Order     string      `json:"order"`
+	Sum       *Numeric    `json:"sum"`
+	Deducted  *Numeric    `json:"deducted"`
+	Debt      *Numeric    `json:"debt"`
+	Forgiven  *Numeric    `json:"forgiven"`
+	Policy    string      `json:"policy"`
+	CreatedAt RFC3339Time `json:"created_at"`
+}
+
+//////////////////////////
+// Tier info
+//////////////////////////
+
+type TierInfo struct {
+	Tier       string        `json:"tier,omitempty"` // Empty if the lowest tier is not reached yet
+	Multiplier float64       `json:"multiplier"`
+	Accrued    *Numeric      `json:"accrued"` // Accrued within last 12 months
+	Next       *NextTierInfo `json:"next,omitempty"`
+}
+
+type NextTierInfo struct {
+	Tier      string   `json:"tier"`
+	Threshold *Numeric `json:"threshold"`
+	Remaining *Numeric `json:"remaining"`
+	Progress  float64  `json:"progress"` // From 0 to 1 between current and next tier thresholds
+}
+
+//////////////////////////
+// Referral info
+//////////////////////////
+
+type ReferralInfo struct {
+	Code     string `json:"code"`
+	Invited  int    `json:"invited"`         // Users registered with code
+	Rewarded int    `json:"rewarded"`        // Invited users with processed order
+	Limit    int    `json:"limit,omitempty"` // Max number of invited users (0 - unlimited)
+}
+
+type ReferralReportInfo struct {
+	Referrer      string       `json:"referrer"` // Logins
+	Referee       string       `json:"referee"`
+	CreatedAt     RFC3339Time  `json:"created_at"`
+	RewardedAt    *RFC3339Time `json:"rewarded_at,omitempty"`
+	Order         string       `json:"order,omitempty"` // First processed order of referee
+	ReferrerBonus *Numeric     `json:"referrer_bonus,omitempty"`
+	RefereeBonus  *Numeric     `json:"referee_bonus,omitempty"`
+}
+
+//////////////////////////
+// Campaign info
+//////////////////////////
+
+// CampaignInfo: promotional campaign rule. Bonus is accrual * (multiplier - 1) + fixed_bonus, limited by max_bonus.
+type CampaignInfo struct {
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	StartsAt   RFC3339Time `json:"starts_at"` // Window of order upload time
+	EndsAt     RFC3339Time `json:"ends_at"`
+	FirstOrder bool        `json:"first_order"` // Only first processed order of user is eligible
+	MinAccrual *Numeric    `json:"min_accrual,omitempty"`
+	Multiplier float64     `json:"multiplier"`
+	FixedBonus *Numeric    `json:"fixed_bonus,omitempty"`
+	MaxBonus   *Numeric    `json:"max_bonus,omitempty"`
+	CreatedAt  RFC3339Time `json:"created_at"`
+	UpdatedAt  RFC3339Time `json:"updated_at"`
+}
+
+//////////////////////////
+// Ledger info
+//////////////////////////
+
+type LedgerEntryInfo struct {
+	Kind         string      `json:"kind"`
+	Amount       *Numeric    `json:"amount"`
+	Balance      *Numeric    `json:"balance"` // Running total after entry
+	Order        string      `json:"order,omitempty"`
+	Counterparty string      `json:"counterparty,omitempty"` // Login of the other user of transfer
+	CreatedAt    RFC3339Time `json:"created_at"`
+}
+
+type LedgerInfo struct {
+	Entries []LedgerEntryInfo
+}
+
+//////////////////////////
+// User events
+//////////////////////////
+
+// Types of user events
+const (
+	UserEventOrder   = "order"   // Data is OrderInfo
+	UserEventBalance = "balance" // Data is BalanceInfo without expiring points
+)
+
+// UserEvent: change of user order or balance. Also is the payload of NOTIFY.
+type UserEvent struct {
+	ID     int64           `json:"id"`
+	UserID string          `json:"user_id"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+}
+
+//////////////////////////
+// Webhooks
+//////////////////////////
+
+// Types of webhook events
+const (
+	WebhookOrderProcessed    = "order.processed"    // Data is WebhookOrderEvent
+	WebhookOrderInvalid      = "order.invalid"      // Data is WebhookOrderEvent
+	WebhookWithdrawalCreated = "withdrawal.created" // Data is WebhookWithdrawalEvent
+)
+
+var WebhookEventTypes = []string{WebhookOrderProcessed, WebhookOrderInvalid, WebhookWithdrawalCreated}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"    // Attempts are exhausted
+	DeliveryCancelled = "cancelled" // Webhook is deleted
+)
+
+// WebhookInfo: registered endpoint. Secret is shown on creation only.
+type WebhookInfo struct {
+	ID         string      `json:"id"`
+	URL        string      `json:"url"`
+	Secret     string      `json:"secret,omitempty"`
+	EventTypes []string    `json:"event_types"` // Empty - all events
+	CreatedAt  RFC3339Time `json:"created_at"`
+}
+
+type WebhookOrderEvent struct {
+	UserID   string    `json:"user_id"`
+	Login    string    `json:"login"`
+	Order    OrderInfo `json:"order"`
+	Credited *Numeric  `json:"credited,omitempty"` // Accrual with all bonuses
+	Balance  *Numeric  `json:"balance"`            // Available points after event
+}
+
+type WebhookWithdrawalEvent struct {
+	UserID     string         `json:"user_id"`
+	Login      string         `json:"login"`
+	Withdrawal WithdrawalInfo `json:"withdrawal"`
+	Balance    *Numeric       `json:"balance"` // Available points after event
+}
+
+// WebhookDelivery: event claimed for sending to endpoint
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID string
+	URL       string
+	Secret    string
+	EventID   int64
+	EventType string
+	Data      []byte
+	CreatedAt time.Time // Of event
+	Attempts  int       // Including current one
+}
+
+// WebhookAttempt: result of delivery attempt. Zero NextAttemptAt finishes delivery.
+type WebhookAttempt struct {
+	Delivered     bool
+	StatusCode    int
+	Error         string
+	NextAttemptAt time.Time
+}
+
+// WebhookDeliveryInfo: record of delivery log
+type WebhookDeliveryInfo struct {
+	ID             int64        `json:"id"`
+	EventID        int64        `json:"event_id"`
+	EventType      string       `json:"event_type"`
+	Status         string       `json:"status"`
+	Attempts       int          `json:"attempts"`
+	LastStatusCode int          `json:"last_status_code,omitempty"`
+	LastError      string       `json:"last_error,omitempty"`
+	CreatedAt      RFC3339Time  `json:"created_at"`
+	NextAttemptAt  *RFC3339Time `json:"next_attempt_at,omitempty"` // Pending only
+	FinishedAt     *RFC3339Time `json:"finished_at,omitempty"`
+}
+
+//////////////////////////
+// List query
+//////////////////////////
+
+// Sort fields of lists
+const (
+	SortUploadedAt  = "uploaded_at"  // Orders only, default for orders
+	SortProcessedAt = "processed_at" // Default for withdrawals. Orders without final status are not listed.
+)
+
+// ListQuery: page of orders or withdrawals list. Zero value selects all rows in default order.
+type ListQuery struct {
+	Limit    int       // 0 - no limit
+	Cursor   string    // NextCursor of previous page
+	Statuses []string  // Any of, as shown in response
+	From     time.Time // Lower bound of sort field, inclusive. Zero - unbounded.
+	To       time.Time // Upper bound of sort field, exclusive. Zero - unbounded.
+	SortBy   string    // Empty - default
+	Desc     bool
 }
 
 //////////////////////////
@@ -109,15 +448,32 @@ const (
 )
 
 type OrdersInfo struct {
-	Orders []OrderInfo
+	Orders     []OrderInfo
+	NextCursor string // Empty on last page
 }
 
 type OrderInfo struct {
-	User       string      `json:"-"`
-	Number     string      `json:"number"`
-	Status     OrderStatus `json:"status"`
-	Accrual    *Numeric    `json:"accrual,omitempty"`
-	UploadedAt RFC3339Time `json:"uploaded_at"`
+	id          string
+	User        string       `json:"-"`
+	Number      string       `json:"number"`
+	Status      OrderStatus  `json:"status"`
+	Accrual     *Numeric     `json:"accrual,omitempty"`
+	Bonus       *Numeric     `json:"bonus,omitempty"` // Added to accrual by loyalty tier
+	UploadedAt  RFC3339Time  `json:"uploaded_at"`
+	ProcessedAt *RFC3339Time `json:"processed_at,omitempty"` // Set when order reaches final status
+}
+
+// Statuses of orders in batch upload
+const (
+	BatchOrderAccepted        = "accepted"         // New order, queued for accrual
+	BatchOrderAlreadyUploaded = "already_uploaded" // Order was uploaded by the same user before
+	BatchOrderOtherUser       = "other_user"       // Order belongs to other user
+	BatchOrderInvalid         = "invalid"          // Order number failed validation
+)
+
+type BatchOrderResult struct {
+	Number string `json:"number"`
+	Status string `json:"status"`
 }
 
 // RFC3339 Time
@@ -127,6 +483,15 @@ func (rfTime RFC3339Time) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + time.Time(rfTime).Format(time.RFC3339) + `"`), nil
 }
 
+func (rfTime *RFC3339Time) UnmarshalJSON(data []byte) error {
+	var t time.Time
+	if err := t.UnmarshalJSON(data); err != nil {
+		return err
+	}
+	*rfTime = RFC3339Time(t)
+	return nil
+}
+
 // Status code
 type OrderStatus int64
 
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//////////////////////////
+// Versioned schema migrations
+//////////////////////////
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var ErrSchemaTooNew error = errors.New("database schema is newer than this binary supports")
+var ErrNoMigrationsToRevert error = errors.New("no applied migrations to revert")
+
+// Key of advisory lock, which serializes migrations of concurrent replicas
+const migrationLockID int64 = 0x676f7068 // "goph"
+
+var queryCreateSchemaMigrations string = `CREATE TABLE IF NOT EXISTS public.schema_migrations
+(
+    version integer NOT NULL,
+    name text NOT NULL,
+    applied_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (version)
+);`
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+var migrations = mustLoadMigrations(migrationFiles)
+
+func mustLoadMigrations(fsys fs.FS) []migration {
+	re := regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	files, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		panic(err)
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, v := range files {
+		name := v[len("migrations/"):]
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			panic(fmt.Sprintf("incorrect migration file name: %s", name))
+		}
+		version, _ := strconv.Atoi(m[1])
+		data, err := fs.ReadFile(fsys, v)
+		if err != nil {
+			panic(err)
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			panic(fmt.Sprintf("migration %d has different names: %s, %s", version, mig.Name, m[2]))
+		}
+		if m[3] == "up" {
+			mig.Up = string(data)
+		} else {
+			mig.Down = string(data)
+		}
+	}
+
+	res := make([]migration, 0, len(byVersion))
+	for _, v := range byVersion {
+		if v.Up == "" || v.Down == "" {
+			panic(fmt.Sprintf("migration %d must have both up and down files", v.Version))
+		}
+		res = append(res, *v)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	for i, v := range res {
+		if v.Version != i+1 {
+			panic(fmt.Sprintf("migration versions must be sequential, got %d at position %d", v.Version, i+1))
+		}
+	}
+	return res
+}
+
+// LatestSchemaVersion returns newest schema version known to this binary
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// withMigrationLock runs f on single connection holding migration advisory lock
+func (s *Storage) withMigrationLock(ctx context.Context, f func(conn *pgxpool.Conn) error) error {
+	conn, err := s.dbConn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return err
+	}
+	defer func() {
+		// Context may already be cancelled, lock must be released anyway
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID); err != nil {
+			s.logger.Sugar().Errorf("Unable to release migration lock: %s", err.Error())
+		}
+	}()
+
+	if _, err = conn.Exec(ctx, queryCreateSchemaMigrations); err != nil {
+		return err
+	}
+
+	return f(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[int]time.Time, error) {
+	rows, err := conn.Query(ctx, "SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+func checkSchemaVersion(applied map[int]time.Time) error {
+	for v := range applied {
+		if v > LatestSchemaVersion() {
+			return fmt.Errorf("schema version %d, binary supports up to %d: %w", v, LatestSchemaVersion(), ErrSchemaTooNew)
+		}
+	}
+	return nil
+}
+
+func (s *Storage) applyMigration(ctx context.Context, conn *pgxpool.Conn, query string, register func(pgx.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err = tx.Exec(ctx, query); err != nil {
+		return err
+	}
+	if err = register(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// MigrateUp applies all pending migrations, returns number of applied ones
+func (s *Storage) MigrateUp(ctx context.Context) (int, error) {
+	count := 0
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = checkSchemaVersion(applied); err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			m := m
+			err = s.applyMigration(ctx, conn, m.Up, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			s.logger.Sugar().Infof("Applied migration %d_%s", m.Version, m.Name)
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown reverts given number of most recent migrations
+func (s *Storage) MigrateDown(ctx context.Context, steps int) error {
+	return s.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err = checkSchemaVersion(applied); err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return ErrNoMigrationsToRevert
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			err = s.applyMigration(ctx, conn, m.Down, func(tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("revert migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			s.logger.Sugar().Infof("Reverted migration %d_%s", m.Version, m.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatus lists known migrations and their state. Unknown (newer) applied versions produce ErrSchemaTooNew.
+func (s *Storage) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var res []MigrationStatus
+	err := s.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		res = make([]MigrationStatus, 0, len(migrations))
+		for _, m := range migrations {
+			appliedAt, ok := applied[m.Version]
+			res = append(res, MigrationStatus{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: appliedAt})
+		}
+		return checkSchemaVersion(applied)
+	})
+	return res, err
+}
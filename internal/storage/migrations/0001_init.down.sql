@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.withdrawals;
+DROP TABLE IF EXISTS public.orders;
+DROP TABLE IF EXISTS public.users;
@@ -1,6 +1,7 @@
-package storage
+-- Tables are created only if absent: schema of deployments predating migrations is adopted as is
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
-var queryCreateUsers string = `CREATE TABLE IF NOT EXISTS public.users
+CREATE TABLE IF NOT EXISTS public.users
 (
     id uuid NOT NULL DEFAULT uuid_generate_v4(),
     login text NOT NULL,
@@ -15,8 +16,9 @@ var queryCreateUsers string = `CREATE TABLE IF NOT EXISTS public.users
 )
 WITH (
     OIDS = FALSE
-);`
-var queryCreateOrders string = `CREATE TABLE IF NOT EXISTS public.orders
+);
+
+CREATE TABLE IF NOT EXISTS public.orders
 (
     id uuid NOT NULL DEFAULT uuid_generate_v4(),
     order_num text NOT NULL,
@@ -33,10 +35,10 @@ var queryCreateOrders string = `CREATE TABLE IF NOT EXISTS public.orders
 )
 WITH (
     OIDS = FALSE
-);`
+);
 
-// order_num can be absent in "orders" table
-var queryCreateWithdrawals string = `CREATE TABLE IF NOT EXISTS public.withdrawals
+-- order_num can be absent in "orders" table
+CREATE TABLE IF NOT EXISTS public.withdrawals
 (
     id uuid NOT NULL DEFAULT uuid_generate_v4(),
     user_id uuid NOT NULL,
@@ -50,4 +52,4 @@ var queryCreateWithdrawals string = `CREATE TABLE IF NOT EXISTS public.withdrawa
 )
 WITH (
     OIDS = FALSE
-);`
+);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS public.sessions
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    user_id uuid NOT NULL,
+    refresh_hash text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    refreshed_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    expires_at timestamp with time zone NOT NULL,
+    revoked_at timestamp with time zone,
+    PRIMARY KEY (id),
+    CONSTRAINT uk_refresh_hash UNIQUE (refresh_hash),
+    CONSTRAINT fk_users_id 
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON public.sessions (user_id) WHERE revoked_at IS NULL;
@@ -0,0 +1,40 @@
+-- Every change of users.balance/withdrawn is mirrored by ledger entry within same transaction.
+-- amount is signed change of user account, counter_account is the other side of the entry.
+CREATE TABLE IF NOT EXISTS public.ledger_entries
+(
+    id bigserial NOT NULL,
+    user_id uuid NOT NULL,
+    kind text NOT NULL,
+    amount bigint NOT NULL,
+    counter_account text NOT NULL,
+    order_num text,
+    withdrawal_id uuid,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_id 
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id),
+    CONSTRAINT fk_withdrawals_id 
+		FOREIGN KEY (withdrawal_id)
+        REFERENCES public.withdrawals (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_user_id ON public.ledger_entries (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_order_num ON public.ledger_entries (order_num);
+
+-- Ledger entries for accruals and withdrawals made before ledger was introduced
+INSERT INTO ledger_entries (user_id, kind, amount, counter_account, order_num, withdrawal_id, created_at)
+SELECT user_id, kind, amount, counter_account, order_num, withdrawal_id, created_at FROM (
+    SELECT o.user_id, 'accrual' AS kind, o.accrual AS amount, 'system:accrual' AS counter_account,
+        o.order_num, NULL::uuid AS withdrawal_id, o.uploaded_at AS created_at
+    FROM orders o
+    WHERE o.status = 3 AND o.accrual > 0
+        AND NOT EXISTS (SELECT 1 FROM ledger_entries l WHERE l.order_num = o.order_num AND l.kind = 'accrual')
+    UNION ALL
+    SELECT w.user_id, 'withdrawal', -w.sum, 'system:withdrawals', w.order_num, w.id, w.processed_at
+    FROM withdrawals w
+    WHERE NOT EXISTS (SELECT 1 FROM ledger_entries l WHERE l.withdrawal_id = w.id)
+) AS missing
+ORDER BY created_at;
@@ -0,0 +1,26 @@
+-- Durable queue of orders to be polled in accrual system. Job is deleted, when order becomes final.
+-- Job is claimed by worker for locked_until, so replicas never poll the same order simultaneously.
+CREATE TABLE IF NOT EXISTS public.accrual_jobs
+(
+    order_num text NOT NULL,
+    next_poll_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    locked_by text,
+    locked_until timestamp with time zone,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (order_num),
+    CONSTRAINT fk_orders_order_num 
+		FOREIGN KEY (order_num)
+        REFERENCES public.orders (order_num)
+        ON DELETE CASCADE
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_accrual_jobs_next_poll_at ON public.accrual_jobs (next_poll_at);
+
+-- Orders, which were not finalized before queue was introduced
+INSERT INTO accrual_jobs (order_num, created_at)
+SELECT order_num, uploaded_at FROM orders WHERE NOT is_final
+ON CONFLICT DO NOTHING;
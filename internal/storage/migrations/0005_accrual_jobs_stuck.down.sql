@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.idx_accrual_jobs_stuck_at;
+ALTER TABLE public.accrual_jobs DROP COLUMN IF EXISTS retried_at;
+ALTER TABLE public.accrual_jobs DROP COLUMN IF EXISTS stuck_at;
@@ -0,0 +1,5 @@
+-- Jobs, which exceeded retry policy, are not polled until admin retries them
+ALTER TABLE public.accrual_jobs ADD COLUMN IF NOT EXISTS stuck_at timestamp with time zone;
+-- Start of current retry series: creation or last manual retry
+ALTER TABLE public.accrual_jobs ADD COLUMN IF NOT EXISTS retried_at timestamp with time zone;
+CREATE INDEX IF NOT EXISTS idx_accrual_jobs_stuck_at ON public.accrual_jobs (stuck_at) WHERE stuck_at IS NOT NULL;
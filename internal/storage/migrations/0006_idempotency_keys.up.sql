@@ -0,0 +1,18 @@
+-- Responses of requests with Idempotency-Key header, replayed on client retry
+CREATE TABLE IF NOT EXISTS public.idempotency_keys
+(
+    user_id uuid NOT NULL,
+    key text NOT NULL,
+    request_hash text NOT NULL,
+    status_code integer,
+    response bytea,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (user_id, key),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id)
+        ON DELETE CASCADE
+)
+WITH (
+    OIDS = FALSE
+);
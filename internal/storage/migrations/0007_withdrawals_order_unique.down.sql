@@ -0,0 +1 @@
+DROP INDEX IF EXISTS public.uk_withdrawals_order_num;
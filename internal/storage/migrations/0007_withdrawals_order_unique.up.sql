@@ -0,0 +1,3 @@
+-- Order may be paid with bonus points only once.
+-- Fails if database already contains duplicate withdrawals: they have to be resolved manually.
+CREATE UNIQUE INDEX IF NOT EXISTS uk_withdrawals_order_num ON public.withdrawals (order_num);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.holds;
+ALTER TABLE public.users DROP CONSTRAINT IF EXISTS chk_users_held;
+ALTER TABLE public.users DROP COLUMN IF EXISTS held;
@@ -0,0 +1,31 @@
+-- Points reserved by holds are excluded from available balance (balance - held)
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS held bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.users DROP CONSTRAINT IF EXISTS chk_users_held;
+ALTER TABLE public.users ADD CONSTRAINT chk_users_held CHECK (held >= 0 AND held <= balance);
+
+-- Hold is active until it is captured (turned into withdrawal), voided or expired
+CREATE TABLE IF NOT EXISTS public.holds
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    user_id uuid NOT NULL,
+    order_num text NOT NULL,
+    sum bigint NOT NULL,
+    status text NOT NULL DEFAULT 'active',
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    expires_at timestamp with time zone NOT NULL,
+    finished_at timestamp with time zone,
+    withdrawal_id uuid,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_holds_sum CHECK (sum > 0),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id),
+    CONSTRAINT fk_withdrawals_id
+		FOREIGN KEY (withdrawal_id)
+        REFERENCES public.withdrawals (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE UNIQUE INDEX IF NOT EXISTS uk_holds_active_order_num ON public.holds (order_num) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_holds_active_expires_at ON public.holds (expires_at) WHERE status = 'active';
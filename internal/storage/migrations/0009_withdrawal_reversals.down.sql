@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.withdrawal_reversals;
+ALTER TABLE public.withdrawals DROP CONSTRAINT IF EXISTS chk_withdrawals_reversed;
+ALTER TABLE public.withdrawals DROP COLUMN IF EXISTS reversed;
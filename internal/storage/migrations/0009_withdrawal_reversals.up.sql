@@ -0,0 +1,23 @@
+-- Refunded part of withdrawal. Status of withdrawal is derived from it.
+ALTER TABLE public.withdrawals ADD COLUMN IF NOT EXISTS reversed bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.withdrawals DROP CONSTRAINT IF EXISTS chk_withdrawals_reversed;
+ALTER TABLE public.withdrawals ADD CONSTRAINT chk_withdrawals_reversed CHECK (reversed >= 0 AND reversed <= sum);
+
+CREATE TABLE IF NOT EXISTS public.withdrawal_reversals
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    withdrawal_id uuid NOT NULL,
+    sum bigint NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_withdrawal_reversals_sum CHECK (sum > 0),
+    CONSTRAINT fk_withdrawals_id
+		FOREIGN KEY (withdrawal_id)
+        REFERENCES public.withdrawals (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_withdrawal_reversals_withdrawal_id ON public.withdrawal_reversals (withdrawal_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS public.accrual_adjustments;
+ALTER TABLE public.orders DROP COLUMN IF EXISTS clawed_back;
+ALTER TABLE public.users DROP CONSTRAINT IF EXISTS chk_debt_not_negative;
+ALTER TABLE public.users DROP COLUMN IF EXISTS debt;
@@ -0,0 +1,34 @@
+-- Points, which were clawed back but could not be deducted from balance. Repaid from next accruals.
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS debt bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.users DROP CONSTRAINT IF EXISTS chk_debt_not_negative;
+ALTER TABLE public.users ADD CONSTRAINT chk_debt_not_negative CHECK (debt >= 0);
+
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS clawed_back bigint NOT NULL DEFAULT 0;
+
+-- Clawbacks of previously granted accruals. sum = deducted + debt + forgiven.
+CREATE TABLE IF NOT EXISTS public.accrual_adjustments
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    order_num text NOT NULL,
+    user_id uuid NOT NULL,
+    sum bigint NOT NULL,
+    deducted bigint NOT NULL,
+    debt bigint NOT NULL,
+    forgiven bigint NOT NULL,
+    policy text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_accrual_adjustments_sum CHECK (sum > 0 AND sum = deducted + debt + forgiven),
+    CONSTRAINT fk_orders_order_num
+		FOREIGN KEY (order_num)
+        REFERENCES public.orders (order_num),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_accrual_adjustments_order_num ON public.accrual_adjustments (order_num);
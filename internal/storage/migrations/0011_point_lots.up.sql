@@ -0,0 +1,39 @@
+-- Every credit of user balance is a lot, debits consume lots in FIFO order (oldest first).
+-- SUM(remaining) of user lots equals users.balance. Lot expires when earned_at + points TTL is passed.
+CREATE TABLE IF NOT EXISTS public.point_lots
+(
+    id bigserial NOT NULL,
+    user_id uuid NOT NULL,
+    ledger_entry_id bigint,
+    order_num text,
+    amount bigint NOT NULL,
+    remaining bigint NOT NULL,
+    earned_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_point_lots_remaining CHECK (remaining >= 0 AND remaining <= amount),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id),
+    CONSTRAINT fk_ledger_entries_id
+		FOREIGN KEY (ledger_entry_id)
+        REFERENCES public.ledger_entries (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_point_lots_user_id ON public.point_lots (user_id, earned_at, id) WHERE remaining > 0;
+CREATE INDEX IF NOT EXISTS idx_point_lots_earned_at ON public.point_lots (earned_at) WHERE remaining > 0;
+
+-- Current balances are split into lots of the latest credits, as if debits had consumed the oldest ones
+INSERT INTO point_lots (user_id, ledger_entry_id, order_num, amount, remaining, earned_at)
+SELECT user_id, id, order_num, amount, LEAST(amount, balance - newer), created_at FROM (
+    SELECT l.user_id, l.id, l.order_num, l.amount, l.created_at, u.balance,
+        COALESCE(SUM(l.amount) OVER (PARTITION BY l.user_id ORDER BY l.created_at DESC, l.id DESC
+            ROWS BETWEEN UNBOUNDED PRECEDING AND 1 PRECEDING), 0) AS newer
+    FROM ledger_entries l
+    JOIN users u ON u.id = l.user_id
+    WHERE l.amount > 0
+) AS credits
+WHERE balance - newer > 0
+    AND NOT EXISTS (SELECT 1 FROM point_lots p WHERE p.ledger_entry_id = credits.id)
+ORDER BY created_at, id;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.idx_ledger_entries_user_kind;
+ALTER TABLE public.orders DROP COLUMN IF EXISTS tier;
+ALTER TABLE public.orders DROP COLUMN IF EXISTS bonus;
@@ -0,0 +1,6 @@
+-- accrual is amount returned by accrual system, bonus is added on top of it by loyalty tier multiplier
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS bonus bigint NOT NULL DEFAULT 0;
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS tier text;
+
+-- Rolling sum of accruals for tier computation
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_user_kind ON public.ledger_entries (user_id, kind, created_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS public.campaign_bonuses;
+DROP TABLE IF EXISTS public.campaigns;
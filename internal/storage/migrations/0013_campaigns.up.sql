@@ -0,0 +1,49 @@
+-- Promotional campaigns. Order is eligible, if it was uploaded within [starts_at, ends_at),
+-- its accrual is not less than min_accrual and (if first_order) it is the first processed order of user.
+-- Bonus is accrual * (multiplier - 1) + fixed_bonus, limited by max_bonus.
+CREATE TABLE IF NOT EXISTS public.campaigns
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    name text NOT NULL,
+    starts_at timestamp with time zone NOT NULL,
+    ends_at timestamp with time zone NOT NULL,
+    first_order boolean NOT NULL DEFAULT false,
+    min_accrual bigint NOT NULL DEFAULT 0,
+    multiplier double precision NOT NULL DEFAULT 1,
+    fixed_bonus bigint NOT NULL DEFAULT 0,
+    max_bonus bigint,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    updated_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    deleted_at timestamp with time zone,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_campaigns_window CHECK (ends_at > starts_at),
+    CONSTRAINT chk_campaigns_bonus CHECK (multiplier >= 1 AND fixed_bonus >= 0 AND min_accrual >= 0 AND (max_bonus IS NULL OR max_bonus > 0))
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_campaigns_window ON public.campaigns (starts_at, ends_at) WHERE deleted_at IS NULL;
+
+-- Bonuses applied by campaigns, each one is posted as separate 'campaign' ledger entry
+CREATE TABLE IF NOT EXISTS public.campaign_bonuses
+(
+    campaign_id uuid NOT NULL,
+    order_num text NOT NULL,
+    user_id uuid NOT NULL,
+    amount bigint NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (campaign_id, order_num),
+    CONSTRAINT fk_campaigns_id
+		FOREIGN KEY (campaign_id)
+        REFERENCES public.campaigns (id),
+    CONSTRAINT fk_orders_order_num
+		FOREIGN KEY (order_num)
+        REFERENCES public.orders (order_num),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_campaign_bonuses_order_num ON public.campaign_bonuses (order_num);
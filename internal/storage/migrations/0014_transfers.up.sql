@@ -0,0 +1,24 @@
+-- Points transfers between users. Each transfer is posted as pair of ledger entries: 'transfer_out' of sender
+-- and 'transfer_in' of recipient, counter account of each one is the other user ('user:<id>').
+CREATE TABLE IF NOT EXISTS public.transfers
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    sender_id uuid NOT NULL,
+    recipient_id uuid NOT NULL,
+    sum bigint NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_transfers_sum CHECK (sum > 0),
+    CONSTRAINT chk_transfers_users CHECK (sender_id <> recipient_id),
+    CONSTRAINT fk_users_sender_id
+		FOREIGN KEY (sender_id)
+        REFERENCES public.users (id),
+    CONSTRAINT fk_users_recipient_id
+		FOREIGN KEY (recipient_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_transfers_sender_id ON public.transfers (sender_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_transfers_recipient_id ON public.transfers (recipient_id, created_at);
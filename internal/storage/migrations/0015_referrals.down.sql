@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.referrals;
+DROP INDEX IF EXISTS public.uk_users_referral_code;
+ALTER TABLE public.users DROP COLUMN IF EXISTS referral_code;
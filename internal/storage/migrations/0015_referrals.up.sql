@@ -0,0 +1,27 @@
+-- Shareable referral code, generated on first request
+ALTER TABLE public.users ADD COLUMN IF NOT EXISTS referral_code text;
+CREATE UNIQUE INDEX IF NOT EXISTS uk_users_referral_code ON public.users (referral_code);
+
+-- User can be referred once, on registration. Both users are rewarded, when first order of referee is processed.
+CREATE TABLE IF NOT EXISTS public.referrals
+(
+    referee_id uuid NOT NULL,
+    referrer_id uuid NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    rewarded_at timestamp with time zone,
+    order_num text,
+    referrer_bonus bigint NOT NULL DEFAULT 0,
+    referee_bonus bigint NOT NULL DEFAULT 0,
+    PRIMARY KEY (referee_id),
+    CONSTRAINT chk_referrals_users CHECK (referee_id <> referrer_id),
+    CONSTRAINT fk_users_referee_id
+		FOREIGN KEY (referee_id)
+        REFERENCES public.users (id),
+    CONSTRAINT fk_users_referrer_id
+		FOREIGN KEY (referrer_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+CREATE INDEX IF NOT EXISTS idx_referrals_referrer_id ON public.referrals (referrer_id);
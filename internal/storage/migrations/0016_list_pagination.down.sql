@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS public.idx_withdrawals_user_processed_at;
+DROP INDEX IF EXISTS public.idx_orders_user_processed_at;
+DROP INDEX IF EXISTS public.idx_orders_user_uploaded_at;
+ALTER TABLE public.orders DROP COLUMN IF EXISTS processed_at;
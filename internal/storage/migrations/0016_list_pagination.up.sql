@@ -0,0 +1,8 @@
+-- Time order reached final status (PROCESSED or INVALID). Orders finalized before this migration get upload time.
+ALTER TABLE public.orders ADD COLUMN IF NOT EXISTS processed_at timestamp with time zone;
+UPDATE public.orders SET processed_at = uploaded_at WHERE is_final AND processed_at IS NULL;
+
+-- Keyset pagination of user lists: (sort field, id) is the cursor
+CREATE INDEX IF NOT EXISTS idx_orders_user_uploaded_at ON public.orders (user_id, uploaded_at, id);
+CREATE INDEX IF NOT EXISTS idx_orders_user_processed_at ON public.orders (user_id, processed_at, id) WHERE processed_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_withdrawals_user_processed_at ON public.withdrawals (user_id, processed_at, id);
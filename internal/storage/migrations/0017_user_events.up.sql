@@ -0,0 +1,19 @@
+-- Events of user orders and balance, streamed to clients. id is the SSE event id, clients resume after it.
+CREATE TABLE IF NOT EXISTS public.user_events
+(
+    id bigserial NOT NULL,
+    user_id uuid NOT NULL,
+    type text NOT NULL,
+    data jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_users_id
+		FOREIGN KEY (user_id)
+        REFERENCES public.users (id)
+)
+WITH (
+    OIDS = FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_events_user_id ON public.user_events (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_user_events_created_at ON public.user_events (created_at);
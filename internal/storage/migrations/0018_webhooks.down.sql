@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS public.webhook_deliveries;
+DROP TABLE IF EXISTS public.webhook_events;
+DROP TABLE IF EXISTS public.webhooks;
@@ -0,0 +1,62 @@
+-- Registered webhook endpoints. Empty event_types - all events.
+CREATE TABLE IF NOT EXISTS public.webhooks
+(
+    id uuid NOT NULL DEFAULT uuid_generate_v4(),
+    url text NOT NULL,
+    secret text NOT NULL,
+    event_types text[] NOT NULL DEFAULT '{}',
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    deleted_at timestamp with time zone,
+    PRIMARY KEY (id)
+)
+WITH (
+    OIDS = FALSE
+);
+
+-- Outbox: events are written in the transaction, which produced them, and fanned out to deliveries later
+CREATE TABLE IF NOT EXISTS public.webhook_events
+(
+    id bigserial NOT NULL,
+    type text NOT NULL,
+    data jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    dispatched_at timestamp with time zone,
+    PRIMARY KEY (id)
+)
+WITH (
+    OIDS = FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_events_not_dispatched ON public.webhook_events (id) WHERE dispatched_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_webhook_events_created_at ON public.webhook_events (created_at);
+
+-- Delivery of event to endpoint, also is the delivery log
+CREATE TABLE IF NOT EXISTS public.webhook_deliveries
+(
+    id bigserial NOT NULL,
+    webhook_id uuid NOT NULL,
+    event_id bigint NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    attempts int NOT NULL DEFAULT 0,
+    next_attempt_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    locked_until timestamp with time zone,
+    last_status_code int,
+    last_error text,
+    created_at timestamp with time zone NOT NULL DEFAULT current_timestamp,
+    finished_at timestamp with time zone,
+    PRIMARY KEY (id),
+    CONSTRAINT uk_webhook_deliveries_event UNIQUE (webhook_id, event_id),
+    CONSTRAINT chk_webhook_deliveries_status CHECK (status IN ('pending', 'delivered', 'failed', 'cancelled')),
+    CONSTRAINT fk_webhooks_id
+		FOREIGN KEY (webhook_id)
+        REFERENCES public.webhooks (id),
+    CONSTRAINT fk_webhook_events_id
+		FOREIGN KEY (event_id)
+        REFERENCES public.webhook_events (id) ON DELETE CASCADE
+)
+WITH (
+    OIDS = FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON public.webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON public.webhook_deliveries (event_id);
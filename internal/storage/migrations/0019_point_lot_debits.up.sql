@@ -0,0 +1,20 @@
+-- Lots consumed by withdrawals. Reversal restores points with their original earned_at, so refunded points
+-- expire as if they were never spent. Withdrawals made before this migration are restored with the withdrawal time.
+CREATE TABLE IF NOT EXISTS public.point_lot_debits
+(
+    id bigserial NOT NULL,
+    ledger_entry_id bigint NOT NULL,
+    amount bigint NOT NULL,
+    restored bigint NOT NULL DEFAULT 0,
+    earned_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT chk_point_lot_debits_restored CHECK (restored >= 0 AND restored <= amount),
+    CONSTRAINT fk_ledger_entries_id
+		FOREIGN KEY (ledger_entry_id)
+        REFERENCES public.ledger_entries (id)
+)
+WITH (
+    OIDS = FALSE
+);
+
+CREATE INDEX IF NOT EXISTS idx_point_lot_debits_ledger_entry_id ON public.point_lot_debits (ledger_entry_id, earned_at, id);
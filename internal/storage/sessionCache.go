@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+//////////////////////////
+// In-process cache of session revocation state
+//////////////////////////
+
+type sessionCacheEntry struct {
+	revoked bool
+	until   time.Time
+}
+
+type sessionCache struct {
+	m       sync.RWMutex
+	ttl     time.Duration
+	entries map[string]sessionCacheEntry
+}
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{ttl: ttl, entries: make(map[string]sessionCacheEntry)}
+}
+
+// get returns cached revocation state and whether it is present and fresh
+func (sc *sessionCache) get(sessionID string) (bool, bool) {
+	sc.m.RLock()
+	defer sc.m.RUnlock()
+	e, ok := sc.entries[sessionID]
+	if !ok || time.Now().After(e.until) {
+		return false, false
+	}
+	return e.revoked, true
+}
+
+// clear drops all entries, so state of sessions is read from database again
+func (sc *sessionCache) clear() {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	sc.entries = make(map[string]sessionCacheEntry)
+}
+
+func (sc *sessionCache) set(sessionID string, revoked bool) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	now := time.Now()
+	// Drop stale entries before map grows too much
+	if len(sc.entries) >= 10000 {
+		for k, v := range sc.entries {
+			if now.After(v.until) {
+				delete(sc.entries, k)
+			}
+		}
+	}
+	sc.entries[sessionID] = sessionCacheEntry{revoked: revoked, until: now.Add(sc.ttl)}
+}
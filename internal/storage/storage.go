@@ -2,12 +2,13 @@ package storage
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
 	"errors"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 	"sync"
+	"time"
 	"yapracticum-go-diploma-1/internal/config"
 	"yapracticum-go-diploma-1/internal/utils"
 )
@@ -21,42 +22,80 @@ var ErrUserAuthFailed error = errors.New("authentication failed")
 var ErrUserNotLoggedIn error = errors.New("user session has expired")
 var ErrOrderAlreadyExists error = errors.New("this order already exists in database")
 var ErrOrderOtherUser error = errors.New("this order belongs to other user")
+var ErrWithdrawalAlreadyExists error = errors.New("this order is already paid with bonus points")
+var ErrWithdrawalNotFound error = errors.New("withdrawal not found")
+var ErrReversalExceedsWithdrawal error = errors.New("reversal sum exceeds not reversed part of withdrawal")
+var ErrOrderNotFound error = errors.New("order not found")
+var ErrClawbackExceedsAccrual error = errors.New("clawback sum exceeds not clawed back accrual of order")
+var ErrClawbackNotEnough error = errors.New("not enough bonus points for clawback")
 var ErrWithdrawNotEnough error = errors.New("hot enough bonus points")
 var ErrOrderLuhnCheckFailed error = errors.New("incorrect order number (Luhn check)")
 var ErrNoDataChanged error = errors.New("no data was changed")
 var ErrUnknownAccrualStatus error = errors.New("unknown accrual status")
+var ErrSessionNotFound error = errors.New("session not found, expired or revoked")
+var ErrHoldAlreadyExists error = errors.New("this order already has active hold")
+var ErrHoldNotFound error = errors.New("hold not found")
+var ErrHoldNotActive error = errors.New("hold is already captured, voided or expired")
+var ErrTransferRecipientNotFound error = errors.New("transfer recipient not found")
+var ErrTransferToSelf error = errors.New("transfer to yourself")
+var ErrTransferLimitExceeded error = errors.New("daily transfer limit exceeded")
+var ErrReferralCodeNotFound error = errors.New("referral code not found")
+var ErrReferralLimitExceeded error = errors.New("referrer has reached the limit of referrals")
+var ErrCampaignNotFound error = errors.New("campaign not found")
+var ErrCampaignInvalid error = errors.New("invalid campaign rule")
+var ErrBatchTooLarge error = errors.New("too many orders in batch")
+var ErrWebhookNotFound error = errors.New("webhook not found")
+var ErrWebhookInvalid error = errors.New("invalid webhook")
+var ErrListQueryInvalid error = errors.New("invalid list query")
+var ErrTiersDisabled error = errors.New("loyalty tiers are disabled")
+var ErrIdempotencyKeyReused error = errors.New("idempotency key was used with other request")
+var ErrUserDataInvalid error = errors.New("login, password or referral code is not valid text")
+
+// isDataException reports whether database rejected query argument itself, e.g. text with NUL character
+func isDataException(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgerrcode.IsDataException(pgErr.Code)
+}
 
 type Storage struct {
 	dbConn      *pgxpool.Pool
 	config      config.Config
-	encKey      string
 	logger      *zap.Logger
+	keys        *utils.KeyRing     // JWT signing keys
+	sessions    *sessionCache      // Session revocation cache
 	rStarter    sync.Once          // First Init call detector
 	workersWg   *sync.WaitGroup    // WaitGroup for Storage Workers
 	stopWorkers context.CancelFunc // Cancel function for Storage Workers Context
 	workersCtx  context.Context    // Storage Workers Context
-	newOrdersCh chan OrderTag      // Channel for orders to be processed
+
+	events *eventsHub // Subscribers of user events
+
+	jobListenerM sync.RWMutex
+	jobListener  func(orderNum string, due time.Time) // Notified about new accrual jobs
 }
 
-func New(config config.Config, logger *zap.Logger, newOrdersCh chan OrderTag) (*Storage, error) {
-	encKey := make([]byte, 128)
-	_, err := rand.Read(encKey)
+func New(config config.Config, logger *zap.Logger) (*Storage, error) {
+	var keys *utils.KeyRing
+	var err error
+	if config.JWTKeys == "" && config.JWTKeyFile == "" {
+		logger.Warn("No JWT keys configured, using ephemeral key. Sessions will not survive restart")
+		keys, err = utils.NewEphemeralKeyRing()
+	} else {
+		keys, err = utils.LoadKeyRing(config.JWTKeys, config.JWTKeyFile)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if cap(newOrdersCh) < 10 {
-		return nil, errors.New("channel for processing orders must be buffered with capacity >= 10")
-	}
-
 	s := Storage{
 		config:      config,
 		logger:      logger,
-		encKey:      hex.EncodeToString(encKey),
+		keys:        keys,
+		sessions:    newSessionCache(config.SessionCacheTTL),
+		events:      newEventsHub(),
 		stopWorkers: nil,
 		workersCtx:  nil,
 		workersWg:   &sync.WaitGroup{},
-		newOrdersCh: newOrdersCh,
 	}
 
 	poolConfig, err := pgxpool.ParseConfig(s.config.ConnString)
@@ -83,32 +122,40 @@ func (s *Storage) Init(ctx context.Context) error {
 		s.workersCtx, s.stopWorkers = context.WithCancel(ctx)
 	}
 
-	// Need execute to use uuid4
-	var err error
+	// Schema is brought to the latest version known to binary. Schema from newer binary is not touched.
 	errs := make([]error, 0)
-	_, err = s.dbConn.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS "uuid-ossp";`)
-	if err != nil {
-		errs = append(errs, err)
-	}
-
-	_, err = s.dbConn.Exec(ctx, queryCreateUsers)
-	if err != nil {
-		errs = append(errs, err)
-	}
-
-	_, err = s.dbConn.Exec(ctx, queryCreateOrders)
+	applied, err := s.MigrateUp(ctx)
 	if err != nil {
+		if errors.Is(err, ErrSchemaTooNew) {
+			return err
+		}
 		errs = append(errs, err)
+	} else if applied > 0 {
+		s.logger.Sugar().Infof("Database schema upgraded to version %d", LatestSchemaVersion())
 	}
 
-	_, err = s.dbConn.Exec(ctx, queryCreateWithdrawals)
-	if err != nil {
+	if mismatched, err := s.VerifyLedger(ctx); err != nil {
 		errs = append(errs, err)
+	} else if len(mismatched) > 0 {
+		s.logger.Sugar().Warnf("Balance of %d users differs from ledger: %v", len(mismatched), mismatched)
 	}
 
 	if firstInit {
 		s.workersWg.Add(1)
 		go s.autoInit(s.workersCtx)
+		if s.keys.File() != "" {
+			s.workersWg.Add(1)
+			go s.keysReload(s.workersCtx)
+		}
+		s.workersWg.Add(1)
+		go s.holdsExpire(s.workersCtx)
+		if s.config.PointsTTLMonths > 0 {
+			s.workersWg.Add(1)
+			go s.pointsExpire(s.workersCtx)
+		}
+		s.workersWg.Add(2)
+		go s.eventsListen(s.workersCtx)
+		go s.userEventsPurge(s.workersCtx)
 	}
 
 	return errors.Join(errs...)
@@ -137,9 +184,26 @@ func (s *Storage) autoInit(ctx context.Context) {
 	}
 }
 
+func (s *Storage) keysReload(ctx context.Context) {
+	defer func() { s.workersWg.Done() }()
+	cw := utils.NewCtxCancelWaiter(ctx, s.config.KeyReloadPeriod)
+
+	for {
+		if cw.Scan() != nil {
+			s.logger.Info("keysReload worker stopped")
+			return
+		}
+		if err := s.keys.Reload(); err != nil {
+			s.logger.Sugar().Errorf("JWT keys reload error: %s", err.Error())
+		}
+	}
+}
+
 func (s *Storage) Close(ctx context.Context) {
 	s.logger.Info("Stopping storage workers...")
-	s.stopWorkers()
+	if s.stopWorkers != nil {
+		s.stopWorkers()
+	}
 	s.workersWg.Wait()
 	s.dbConn.Close()
 }
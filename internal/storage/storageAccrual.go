@@ -2,8 +2,11 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5"
-	"time"
+	"strings"
 )
 
 func (s *Storage) Withdraw(ctx context.Context, userID string, orderNum string, sum Numeric) error {
@@ -19,20 +22,10 @@ func (s *Storage) Withdraw(ctx context.Context, userID string, orderNum string,
 		}
 	}()
 
-	s.logger.Sugar().Infof("Withdraw attempt: Requested: %s", &sum)
-
-	query := `INSERT INTO withdrawals (user_id, order_num, sum) VALUES ($1, $2, $3)`
-	_, err = tx.Exec(ctx, query, userID, orderNum, sum)
-	if err != nil {
+	if _, err = s.withdrawTx(ctx, tx, userID, orderNum, sum); err != nil {
 		return err
 	}
 
-	query = "UPDATE users SET balance = balance - $2, withdrawn = withdrawn + $2 WHERE id = $1"
-	_, err = tx.Exec(ctx, query, userID, sum)
-	if err != nil {
-		return ErrWithdrawNotEnough
-	}
-
 	err = tx.Commit(ctx)
 	if err != nil {
 		return err
@@ -42,51 +35,90 @@ func (s *Storage) Withdraw(ctx context.Context, userID string, orderNum string,
 	return nil
 }
 
-func (s *Storage) GetWithdrawalsData(ctx context.Context, userID string) (WithdrawalsInfo, error) {
-
-	var rows pgx.Rows
-	var err error
-	query := `SELECT order_num, sum, processed_at FROM withdrawals WHERE user_id = $1`
-	rows, err = s.dbConn.Query(ctx, query, userID)
+func (s *Storage) withdrawTx(ctx context.Context, tx pgx.Tx, userID string, orderNum string, sum Numeric) (string, error) {
+	s.logger.Sugar().Infof("Withdraw attempt: Requested: %s", &sum)
 
+	err := s.checkOrderNumber(orderNum)
 	if err != nil {
-		s.logger.Sugar().Errorf(err.Error())
-		return WithdrawalsInfo{}, err
+		return "", err
 	}
 
-	withdrawals := make([]WithdrawalInfo, 0)
-	var (
-		oNumber     string
-		oSum        Numeric
-		oUploadedAt time.Time
-	)
+	// Points of order with active hold are withdrawn by capture only (hold is finished before this check)
+	if err = s.lockOrderPaymentTx(ctx, tx, orderNum); err != nil {
+		return "", err
+	}
+	var held bool
+	query := `SELECT EXISTS (SELECT 1 FROM holds WHERE order_num = $1 AND status = 'active' AND expires_at > NOW())`
+	if err = tx.QueryRow(ctx, query, orderNum).Scan(&held); err != nil {
+		return "", err
+	}
+	if held {
+		return "", ErrHoldAlreadyExists
+	}
 
-	for rows.Next() {
-		err := rows.Scan(&oNumber, &oSum, &oUploadedAt)
-		if err != nil {
-			s.logger.Sugar().Errorf("Query %s, %s", query, err.Error())
-			return WithdrawalsInfo{}, err
+	var withdrawalID string
+	query = `INSERT INTO withdrawals (user_id, order_num, sum) VALUES ($1, $2, $3) RETURNING id`
+	err = tx.QueryRow(ctx, query, userID, orderNum, sum).Scan(&withdrawalID)
+	if err != nil {
+		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
+			s.logger.Sugar().Errorf("Order %s is already paid with bonus points", orderNum)
+			return "", fmt.Errorf("%s: %w", err.Error(), ErrWithdrawalAlreadyExists)
+		}
+		return "", err
+	}
+
+	err = s.postLedger(ctx, tx, ledgerEntry{
+		UserID:         userID,
+		Kind:           LedgerWithdrawal,
+		Amount:         -sum,
+		CounterAccount: AccountWithdrawals,
+		OrderNum:       orderNum,
+		WithdrawalID:   withdrawalID,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), pgerrcode.CheckViolation) {
+			return "", ErrWithdrawNotEnough
 		}
-		withdrawals = append(withdrawals, WithdrawalInfo{Order: oNumber, Sum: &oSum, ProcessedAt: RFC3339Time(oUploadedAt)})
+		return "", err
+	}
+
+	if err = s.addWithdrawalWebhookEventTx(ctx, tx, userID, withdrawalID); err != nil {
+		return "", err
 	}
 
-	return WithdrawalsInfo{Withdrawals: withdrawals}, nil
+	return withdrawalID, nil
+}
+
+// GetWithdrawalsData returns all user withdrawals sorted by processing time
+func (s *Storage) GetWithdrawalsData(ctx context.Context, userID string) (WithdrawalsInfo, error) {
+	return s.GetWithdrawalsPage(ctx, userID, ListQuery{})
 }
 
 func (s *Storage) GetBalance(ctx context.Context, userID string) (BalanceInfo, error) {
-	query := "SELECT balance, withdrawn FROM users WHERE id = $1"
+	query := "SELECT balance, withdrawn, held, debt FROM users WHERE id = $1"
 	row := s.dbConn.QueryRow(ctx, query, userID)
 	var balance int64
 	var withdraw int64
-	err := row.Scan(&balance, &withdraw)
+	var held int64
+	var debt int64
+	err := row.Scan(&balance, &withdraw, &held, &debt)
 	if err != nil {
 		return BalanceInfo{}, err
 	}
 
-	curr := Numeric(balance)
+	curr := Numeric(balance - held)
 	with := Numeric(withdraw)
-	s.logger.Sugar().Infof("Balance: %s, withdrawn: %s", &curr, &with)
-	return BalanceInfo{Current: &curr, Withdrawn: &with}, nil
+	hold := Numeric(held)
+	res := BalanceInfo{Current: &curr, Withdrawn: &with, Held: &hold}
+	if debt > 0 {
+		owed := Numeric(debt)
+		res.Debt = &owed
+	}
+	if res.ExpiringSoon, err = s.getExpiringSoon(ctx, userID); err != nil {
+		return BalanceInfo{}, err
+	}
+	s.logger.Sugar().Infof("Balance: %s, withdrawn: %s, held: %s, debt: %d", &curr, &with, &hold, debt)
+	return res, nil
 }
 
 func (s *Storage) ApplyAccrualResponse(ctx context.Context, response AccrualResponse) error {
@@ -94,24 +126,85 @@ func (s *Storage) ApplyAccrualResponse(ctx context.Context, response AccrualResp
 	case "REGISTERED":
 		return nil
 	case "PROCESSING":
-		query := "UPDATE orders SET status = $1 WHERE order_num = $2 AND NOT is_final"
-		tag, err := s.dbConn.Exec(ctx, query, StatusProcessing, response.Order)
-		if tag.RowsAffected() == 0 {
-			return ErrNoDataChanged
+		txOk := false
+		tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if !txOk {
+				tx.Rollback(ctx)
+			}
+		}()
+
+		var userID string
+		var status OrderStatus
+		query := "SELECT user_id, status FROM orders WHERE order_num = $1 AND NOT is_final FOR UPDATE"
+		err = tx.QueryRow(ctx, query, response.Order).Scan(&userID, &status)
 		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNoDataChanged
+			}
 			return err
 		}
+		// Order is polled until it is final, event is sent on first PROCESSING response only
+		if status == StatusProcessing {
+			return nil
+		}
+
+		query = "UPDATE orders SET status = $1 WHERE order_num = $2"
+		if _, err = tx.Exec(ctx, query, StatusProcessing, response.Order); err != nil {
+			return err
+		}
+		if err = s.addOrderEventTx(ctx, tx, userID, response.Order); err != nil {
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		txOk = true
+
 		return nil
 	case "INVALID":
-		query := "UPDATE orders SET status = $1, is_final = true WHERE order_num = $2 AND NOT is_final"
-		tag, err := s.dbConn.Exec(ctx, query, StatusInvalid, response.Order)
-		if tag.RowsAffected() == 0 {
-			return ErrNoDataChanged
+		txOk := false
+		tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+		if err != nil {
+			return err
 		}
+		defer func() {
+			if !txOk {
+				tx.Rollback(ctx)
+			}
+		}()
+
+		var userID string
+		query := "UPDATE orders SET status = $1, is_final = true, processed_at = NOW() WHERE order_num = $2 AND NOT is_final RETURNING user_id"
+		err = tx.QueryRow(ctx, query, StatusInvalid, response.Order).Scan(&userID)
 		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNoDataChanged
+			}
 			return err
 		}
+
+		if err = s.completeAccrualJobTx(ctx, tx, response.Order); err != nil {
+			return err
+		}
+		if err = s.addOrderEventTx(ctx, tx, userID, response.Order); err != nil {
+			return err
+		}
+		if err = s.addOrderWebhookEventTx(ctx, tx, WebhookOrderInvalid, userID, response.Order, 0); err != nil {
+			return err
+		}
+
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+		txOk = true
+
 		return nil
 	case "PROCESSED":
 		txOk := false
@@ -125,21 +218,78 @@ func (s *Storage) ApplyAccrualResponse(ctx context.Context, response AccrualResp
 			}
 		}()
 
-		query := "UPDATE orders SET status = $1, accrual = $2, is_final = true WHERE order_num = $3 AND NOT is_final"
-		tag, err := tx.Exec(ctx, query, StatusProcessed, response.Accrual, response.Order)
+		accrual := Numeric(0)
+		if response.Accrual != nil {
+			accrual = *response.Accrual
+		}
+
+		var userID string
+		query := "UPDATE orders SET status = $1, accrual = $2, is_final = true, processed_at = NOW() WHERE order_num = $3 AND NOT is_final RETURNING user_id"
+		err = tx.QueryRow(ctx, query, StatusProcessed, accrual, response.Order).Scan(&userID)
 		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return ErrNoDataChanged
+			}
 			return err
 		}
 
-		if tag.RowsAffected() == 0 {
-			tx.Rollback(ctx)
-			return ErrNoDataChanged
+		bonus, err := s.applyTierTx(ctx, tx, userID, response.Order, accrual)
+		if err != nil {
+			return err
 		}
 
-		query = `UPDATE users SET balance = balance + $1 WHERE id =	(SELECT user_id FROM orders WHERE order_num = $2)`
-		_, err = tx.Exec(ctx, query, response.Accrual, response.Order)
+		if accrual > 0 {
+			err = s.postLedger(ctx, tx, ledgerEntry{
+				UserID:         userID,
+				Kind:           LedgerAccrual,
+				Amount:         accrual,
+				CounterAccount: AccountAccrual,
+				OrderNum:       response.Order,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if bonus > 0 {
+			err = s.postLedger(ctx, tx, ledgerEntry{
+				UserID:         userID,
+				Kind:           LedgerBonus,
+				Amount:         bonus,
+				CounterAccount: AccountBonus,
+				OrderNum:       response.Order,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		campaignBonus, err := s.applyCampaignsTx(ctx, tx, userID, response.Order, accrual)
+		if err != nil {
+			return err
+		}
+		referralBonus, err := s.applyReferralTx(ctx, tx, userID, response.Order)
 		if err != nil {
-			return ErrNoDataChanged
+			return err
+		}
+		credited := accrual + bonus + campaignBonus + referralBonus
+		if credited > 0 {
+			if err = s.repayDebtTx(ctx, tx, userID, response.Order, credited); err != nil {
+				return err
+			}
+		}
+
+		if err = s.completeAccrualJobTx(ctx, tx, response.Order); err != nil {
+			return err
+		}
+		if err = s.addOrderEventTx(ctx, tx, userID, response.Order); err != nil {
+			return err
+		}
+		if credited > 0 {
+			if err = s.addBalanceEventTx(ctx, tx, userID); err != nil {
+				return err
+			}
+		}
+		if err = s.addOrderWebhookEventTx(ctx, tx, WebhookOrderProcessed, userID, response.Order, credited); err != nil {
+			return err
 		}
 
 		err = tx.Commit(ctx)
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"time"
+)
+
+// SetAccrualJobListener registers function, which is called when new accrual job is created by this replica
+func (s *Storage) SetAccrualJobListener(listener func(orderNum string, due time.Time)) {
+	s.jobListenerM.Lock()
+	defer s.jobListenerM.Unlock()
+	s.jobListener = listener
+}
+
+func (s *Storage) notifyAccrualJob(orderNum string, due time.Time) {
+	s.jobListenerM.RLock()
+	defer s.jobListenerM.RUnlock()
+	if s.jobListener != nil {
+		s.jobListener(orderNum, due)
+	}
+}
+
+// ListAccrualJobs returns jobs, which can be claimed before given moment
+func (s *Storage) ListAccrualJobs(ctx context.Context, before time.Time) ([]AccrualJobDue, error) {
+	query := `SELECT order_num, GREATEST(next_poll_at, COALESCE(locked_until, next_poll_at)) AS due
+		FROM accrual_jobs
+		WHERE stuck_at IS NULL AND GREATEST(next_poll_at, COALESCE(locked_until, next_poll_at)) <= $1
+		ORDER BY due
+		LIMIT 10000`
+	rows, err := s.dbConn.Query(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]AccrualJobDue, 0)
+	for rows.Next() {
+		var job AccrualJobDue
+		if err = rows.Scan(&job.OrderNum, &job.Due); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// ClaimAccrualJobs locks up to limit due jobs for worker during lease. Jobs locked by other workers are skipped.
+// If orderNum is not empty, only job of this order is claimed.
+func (s *Storage) ClaimAccrualJobs(ctx context.Context, workerID string, orderNum string, limit int, lease time.Duration) ([]AccrualJob, error) {
+	query := `UPDATE accrual_jobs
+		SET locked_by = $1, locked_until = current_timestamp + $3 * interval '1 millisecond', attempts = attempts + 1
+		WHERE order_num IN (
+			SELECT order_num FROM accrual_jobs
+			WHERE next_poll_at <= current_timestamp AND (locked_until IS NULL OR locked_until < current_timestamp)
+				AND stuck_at IS NULL AND ($4 = '' OR order_num = $4)
+			ORDER BY next_poll_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED)
+		RETURNING order_num, attempts, last_error, created_at, COALESCE(retried_at, created_at)`
+	rows, err := s.dbConn.Query(ctx, query, workerID, limit, lease.Milliseconds(), orderNum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]AccrualJob, 0, limit)
+	for rows.Next() {
+		var (
+			job       AccrualJob
+			lastError pgtype.Text
+		)
+		if err = rows.Scan(&job.OrderNum, &job.Attempts, &lastError, &job.CreatedAt, &job.Since); err != nil {
+			return nil, err
+		}
+		job.LastError = lastError.String
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// GetAccrualJobDue returns moment, when job of order can be claimed. Returns false, if order has no pending job
+// (it is completed or stuck).
+func (s *Storage) GetAccrualJobDue(ctx context.Context, orderNum string) (time.Time, bool, error) {
+	var due time.Time
+	query := `SELECT GREATEST(next_poll_at, COALESCE(locked_until, next_poll_at))
+		FROM accrual_jobs WHERE order_num = $1 AND stuck_at IS NULL`
+	err := s.dbConn.QueryRow(ctx, query, orderNum).Scan(&due)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return due, true, nil
+}
+
+// RescheduleAccrualJob releases job lock and schedules next poll
+func (s *Storage) RescheduleAccrualJob(ctx context.Context, orderNum string, nextPollAt time.Time, lastError string) error {
+	query := `UPDATE accrual_jobs SET next_poll_at = $2, last_error = NULLIF($3, ''), locked_by = NULL, locked_until = NULL
+		WHERE order_num = $1`
+	_, err := s.dbConn.Exec(ctx, query, orderNum, nextPollAt, lastError)
+	return err
+}
+
+// CompleteAccrualJob removes job of finalized order
+func (s *Storage) CompleteAccrualJob(ctx context.Context, orderNum string) error {
+	_, err := s.dbConn.Exec(ctx, `DELETE FROM accrual_jobs WHERE order_num = $1`, orderNum)
+	return err
+}
+
+func (s *Storage) completeAccrualJobTx(ctx context.Context, tx pgx.Tx, orderNum string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM accrual_jobs WHERE order_num = $1`, orderNum)
+	return err
+}
+
+// MarkAccrualJobStuck stops polling of job until it is retried manually
+func (s *Storage) MarkAccrualJobStuck(ctx context.Context, orderNum string, lastError string) error {
+	query := `UPDATE accrual_jobs SET stuck_at = current_timestamp, last_error = NULLIF($2, ''), locked_by = NULL, locked_until = NULL
+		WHERE order_num = $1`
+	_, err := s.dbConn.Exec(ctx, query, orderNum, lastError)
+	return err
+}
+
+func (s *Storage) GetStuckAccrualJobs(ctx context.Context) ([]StuckAccrualJob, error) {
+	query := `SELECT j.order_num, o.user_id, j.attempts, j.last_error, j.created_at, j.stuck_at
+		FROM accrual_jobs j JOIN orders o ON o.order_num = j.order_num
+		WHERE j.stuck_at IS NOT NULL
+		ORDER BY j.stuck_at`
+	rows, err := s.dbConn.Query(ctx, query)
+	if err != nil {
+		s.logger.Sugar().Errorf(err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]StuckAccrualJob, 0)
+	for rows.Next() {
+		var (
+			job       StuckAccrualJob
+			lastError pgtype.Text
+			createdAt time.Time
+			stuckAt   time.Time
+		)
+		if err = rows.Scan(&job.Order, &job.UserID, &job.Attempts, &lastError, &createdAt, &stuckAt); err != nil {
+			s.logger.Sugar().Errorf("Query %s, %s", query, err.Error())
+			return nil, err
+		}
+		job.LastError = lastError.String
+		job.CreatedAt = RFC3339Time(createdAt)
+		job.StuckAt = RFC3339Time(stuckAt)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// RetryStuckAccrualJob starts new retry series of stuck job
+func (s *Storage) RetryStuckAccrualJob(ctx context.Context, orderNum string) error {
+	query := `UPDATE accrual_jobs
+		SET stuck_at = NULL, attempts = 0, retried_at = current_timestamp, next_poll_at = current_timestamp
+		WHERE order_num = $1 AND stuck_at IS NOT NULL`
+	tag, err := s.dbConn.Exec(ctx, query, orderNum)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNoDataChanged
+	}
+
+	s.notifyAccrualJob(orderNum, time.Now())
+	return nil
+}
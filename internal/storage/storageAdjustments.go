@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+	"yapracticum-go-diploma-1/internal/config"
+)
+
+// ClawbackAccrual deducts previously granted accrual of order fully (sum is nil) or partially.
+// If available balance is not enough, configured clawback policy is applied.
+func (s *Storage) ClawbackAccrual(ctx context.Context, orderNum string, sum *Numeric, reason string, actor string) (AccrualAdjustmentInfo, error) {
+	policy := s.config.ClawbackPolicy
+	if policy == "" {
+		policy = config.ClawbackReject
+	}
+
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return AccrualAdjustmentInfo{}, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var (
+		userID     string
+		status     OrderStatus
+		accrual    Numeric
+		clawedBack Numeric
+	)
+	// Accrual includes tier and campaign bonuses
+	query := `SELECT user_id, status, COALESCE(accrual, 0) + bonus
+			+ COALESCE((SELECT SUM(amount) FROM campaign_bonuses b WHERE b.order_num = orders.order_num), 0)::bigint,
+			clawed_back
+		FROM orders WHERE order_num = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, orderNum).Scan(&userID, &status, &accrual, &clawedBack)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return AccrualAdjustmentInfo{}, ErrOrderNotFound
+		}
+		return AccrualAdjustmentInfo{}, err
+	}
+
+	amount := accrual - clawedBack
+	if sum != nil {
+		amount = *sum
+	}
+	if status != StatusProcessed || amount <= 0 || amount > accrual-clawedBack {
+		return AccrualAdjustmentInfo{}, ErrClawbackExceedsAccrual
+	}
+
+	var available Numeric
+	query = `SELECT balance - held FROM users WHERE id = $1 FOR UPDATE`
+	if err = tx.QueryRow(ctx, query, userID).Scan(&available); err != nil {
+		return AccrualAdjustmentInfo{}, err
+	}
+
+	var debt, forgiven Numeric
+	deducted := min(amount, max(available, 0))
+	switch rest := amount - deducted; {
+	case rest == 0:
+	case policy == config.ClawbackDebt:
+		debt = rest
+	case policy == config.ClawbackPartial:
+		forgiven = rest
+	default:
+		return AccrualAdjustmentInfo{}, ErrClawbackNotEnough
+	}
+
+	query = `UPDATE orders SET clawed_back = clawed_back + $2 WHERE order_num = $1`
+	if _, err = tx.Exec(ctx, query, orderNum, amount); err != nil {
+		return AccrualAdjustmentInfo{}, err
+	}
+
+	if deducted > 0 {
+		err = s.postLedger(ctx, tx, ledgerEntry{
+			UserID:         userID,
+			Kind:           LedgerAdjustment,
+			Amount:         -deducted,
+			CounterAccount: AccountAdjustments,
+			OrderNum:       orderNum,
+		})
+		if err != nil {
+			return AccrualAdjustmentInfo{}, err
+		}
+	}
+
+	if debt > 0 {
+		query = `UPDATE users SET debt = debt + $2 WHERE id = $1`
+		if _, err = tx.Exec(ctx, query, userID, debt); err != nil {
+			return AccrualAdjustmentInfo{}, err
+		}
+	}
+
+	var createdAt time.Time
+	query = `INSERT INTO accrual_adjustments (order_num, user_id, sum, deducted, debt, forgiven, policy, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at`
+	err = tx.QueryRow(ctx, query, orderNum, userID, amount, deducted, debt, forgiven, policy, reason, actor).Scan(&createdAt)
+	if err != nil {
+		return AccrualAdjustmentInfo{}, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return AccrualAdjustmentInfo{}, err
+	}
+	txOk = true
+
+	s.logger.Sugar().Infof("Accrual of order %s clawed back by %s: %s points (deducted %s, debt %s, forgiven %s), reason: %s",
+		orderNum, actor, &amount, &deducted, &debt, &forgiven, reason)
+	return AccrualAdjustmentInfo{
+		Order:     orderNum,
+		Sum:       &amount,
+		Deducted:  &deducted,
+		Debt:      &debt,
+		Forgiven:  &forgiven,
+		Policy:    policy,
+		CreatedAt: RFC3339Time(createdAt),
+	}, nil
+}
+
+// repayDebtTx repays debt of user from accrual of order. Must be called within transaction after accrual is posted.
+func (s *Storage) repayDebtTx(ctx context.Context, tx pgx.Tx, userID string, orderNum string, accrual Numeric) error {
+	var debt Numeric
+	query := `SELECT debt FROM users WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRow(ctx, query, userID).Scan(&debt); err != nil {
+		return err
+	}
+	repaid := min(debt, accrual)
+	if repaid <= 0 {
+		return nil
+	}
+
+	query = `UPDATE users SET debt = debt - $2 WHERE id = $1`
+	if _, err := tx.Exec(ctx, query, userID, repaid); err != nil {
+		return err
+	}
+
+	s.logger.Sugar().Infof("Debt of user %s repaid from accrual of order %s: %s", userID, orderNum, &repaid)
+	return s.postLedger(ctx, tx, ledgerEntry{
+		UserID:         userID,
+		Kind:           LedgerAdjustment,
+		Amount:         -repaid,
+		CounterAccount: AccountDebt,
+		OrderNum:       orderNum,
+	})
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"math"
+	"strings"
+	"time"
+)
+
+const queryCampaignColumns = `id, name, starts_at, ends_at, first_order, min_accrual, multiplier, fixed_bonus, max_bonus, created_at, updated_at`
+
+// campaignArgs validates campaign and returns its columns for INSERT/UPDATE (without id and timestamps)
+func campaignArgs(c CampaignInfo) ([]any, error) {
+	num := func(n *Numeric) Numeric {
+		if n == nil {
+			return 0
+		}
+		return *n
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = 1
+	}
+	starts, ends := time.Time(c.StartsAt), time.Time(c.EndsAt)
+	switch {
+	case strings.TrimSpace(c.Name) == "":
+		return nil, fmt.Errorf("name is empty: %w", ErrCampaignInvalid)
+	case !ends.After(starts):
+		return nil, fmt.Errorf("ends_at must be after starts_at: %w", ErrCampaignInvalid)
+	case c.Multiplier < 1 || num(c.MinAccrual) < 0 || num(c.FixedBonus) < 0 || (c.MaxBonus != nil && *c.MaxBonus <= 0):
+		return nil, fmt.Errorf("negative bonus: %w", ErrCampaignInvalid)
+	case c.Multiplier == 1 && num(c.FixedBonus) == 0:
+		return nil, fmt.Errorf("campaign gives no bonus: %w", ErrCampaignInvalid)
+	}
+
+	var maxBonus pgtype.Int8
+	if c.MaxBonus != nil {
+		maxBonus = pgtype.Int8{Int64: int64(*c.MaxBonus), Valid: true}
+	}
+	return []any{c.Name, starts, ends, c.FirstOrder, num(c.MinAccrual), c.Multiplier, num(c.FixedBonus), maxBonus}, nil
+}
+
+func scanCampaign(row pgx.Row) (CampaignInfo, error) {
+	var (
+		c          CampaignInfo
+		startsAt   time.Time
+		endsAt     time.Time
+		minAccrual Numeric
+		fixedBonus Numeric
+		maxBonus   pgtype.Int8
+		createdAt  time.Time
+		updatedAt  time.Time
+	)
+	err := row.Scan(&c.ID, &c.Name, &startsAt, &endsAt, &c.FirstOrder, &minAccrual, &c.Multiplier, &fixedBonus, &maxBonus, &createdAt, &updatedAt)
+	if err != nil {
+		return CampaignInfo{}, err
+	}
+	c.StartsAt, c.EndsAt = RFC3339Time(startsAt), RFC3339Time(endsAt)
+	c.CreatedAt, c.UpdatedAt = RFC3339Time(createdAt), RFC3339Time(updatedAt)
+	if minAccrual > 0 {
+		c.MinAccrual = &minAccrual
+	}
+	if fixedBonus > 0 {
+		c.FixedBonus = &fixedBonus
+	}
+	if maxBonus.Valid {
+		limit := Numeric(maxBonus.Int64)
+		c.MaxBonus = &limit
+	}
+	return c, nil
+}
+
+// campaignError converts errors of queries by campaign id
+func campaignError(err error) error {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows), strings.Contains(err.Error(), pgerrcode.InvalidTextRepresentation):
+		return ErrCampaignNotFound
+	case strings.Contains(err.Error(), pgerrcode.CheckViolation):
+		return fmt.Errorf("%s: %w", err.Error(), ErrCampaignInvalid)
+	}
+	return err
+}
+
+func (s *Storage) CreateCampaign(ctx context.Context, campaign CampaignInfo) (CampaignInfo, error) {
+	args, err := campaignArgs(campaign)
+	if err != nil {
+		return CampaignInfo{}, err
+	}
+	query := `INSERT INTO campaigns (name, starts_at, ends_at, first_order, min_accrual, multiplier, fixed_bonus, max_bonus)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING ` + queryCampaignColumns
+	res, err := scanCampaign(s.dbConn.QueryRow(ctx, query, args...))
+	if err != nil {
+		return CampaignInfo{}, campaignError(err)
+	}
+	s.logger.Sugar().Infof("Campaign %s (%s) created", res.ID, res.Name)
+	return res, nil
+}
+
+func (s *Storage) UpdateCampaign(ctx context.Context, campaign CampaignInfo) (CampaignInfo, error) {
+	args, err := campaignArgs(campaign)
+	if err != nil {
+		return CampaignInfo{}, err
+	}
+	query := `UPDATE campaigns SET name = $2, starts_at = $3, ends_at = $4, first_order = $5, min_accrual = $6,
+			multiplier = $7, fixed_bonus = $8, max_bonus = $9, updated_at = NOW()
+		WHERE id = $1 AND deleted_at IS NULL RETURNING ` + queryCampaignColumns
+	res, err := scanCampaign(s.dbConn.QueryRow(ctx, query, append([]any{campaign.ID}, args...)...))
+	if err != nil {
+		return CampaignInfo{}, campaignError(err)
+	}
+	s.logger.Sugar().Infof("Campaign %s (%s) updated", res.ID, res.Name)
+	return res, nil
+}
+
+// DeleteCampaign stops campaign. Campaign is kept in database, as its bonuses refer to it.
+func (s *Storage) DeleteCampaign(ctx context.Context, campaignID string) error {
+	query := `UPDATE campaigns SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := s.dbConn.Exec(ctx, query, campaignID)
+	if err != nil {
+		return campaignError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCampaignNotFound
+	}
+	s.logger.Sugar().Infof("Campaign %s deleted", campaignID)
+	return nil
+}
+
+func (s *Storage) GetCampaign(ctx context.Context, campaignID string) (CampaignInfo, error) {
+	query := `SELECT ` + queryCampaignColumns + ` FROM campaigns WHERE id = $1 AND deleted_at IS NULL`
+	res, err := scanCampaign(s.dbConn.QueryRow(ctx, query, campaignID))
+	if err != nil {
+		return CampaignInfo{}, campaignError(err)
+	}
+	return res, nil
+}
+
+func (s *Storage) GetCampaigns(ctx context.Context) ([]CampaignInfo, error) {
+	query := `SELECT ` + queryCampaignColumns + ` FROM campaigns WHERE deleted_at IS NULL ORDER BY starts_at, id`
+	rows, err := s.dbConn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]CampaignInfo, 0)
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// applyCampaignsTx posts bonuses of all campaigns, which order is eligible for. Must be called within transaction
+// after order is marked as processed. Returns total bonus.
+func (s *Storage) applyCampaignsTx(ctx context.Context, tx pgx.Tx, userID string, orderNum string, accrual Numeric) (Numeric, error) {
+	type applied struct {
+		id     string
+		name   string
+		amount Numeric
+	}
+
+	query := `SELECT c.id, c.name, c.multiplier, c.fixed_bonus, c.max_bonus FROM campaigns c, orders o
+		WHERE o.order_num = $1 AND c.deleted_at IS NULL
+			AND o.uploaded_at >= c.starts_at AND o.uploaded_at < c.ends_at
+			AND $2 >= c.min_accrual
+			AND (NOT c.first_order OR NOT EXISTS (
+				SELECT 1 FROM orders p WHERE p.user_id = o.user_id AND p.order_num <> o.order_num AND p.status = $3
+			))
+		ORDER BY c.starts_at, c.id`
+	rows, err := tx.Query(ctx, query, orderNum, accrual, StatusProcessed)
+	if err != nil {
+		return 0, err
+	}
+	bonuses := make([]applied, 0)
+	for rows.Next() {
+		var (
+			a          applied
+			multiplier float64
+			fixedBonus Numeric
+			maxBonus   pgtype.Int8
+		)
+		if err = rows.Scan(&a.id, &a.name, &multiplier, &fixedBonus, &maxBonus); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		a.amount = Numeric(math.Round(float64(accrual)*(multiplier-1))) + fixedBonus
+		if maxBonus.Valid {
+			a.amount = min(a.amount, Numeric(maxBonus.Int64))
+		}
+		if a.amount > 0 {
+			bonuses = append(bonuses, a)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total Numeric
+	for _, a := range bonuses {
+		query = `INSERT INTO campaign_bonuses (campaign_id, order_num, user_id, amount) VALUES ($1, $2, $3, $4)`
+		if _, err = tx.Exec(ctx, query, a.id, orderNum, userID, a.amount); err != nil {
+			return 0, err
+		}
+		err = s.postLedger(ctx, tx, ledgerEntry{
+			UserID:         userID,
+			Kind:           LedgerCampaign,
+			Amount:         a.amount,
+			CounterAccount: AccountCampaigns,
+			OrderNum:       orderNum,
+		})
+		if err != nil {
+			return 0, err
+		}
+		s.logger.Sugar().Infof("Campaign %s (%s) bonus for order %s: %s points", a.id, a.name, orderNum, &a.amount)
+		total += a.amount
+	}
+	return total, nil
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v5"
+	"sync"
+	"time"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+const (
+	userEventsChannel    = "user_events"         // Postgres NOTIFY channel
+	sessionsChannel      = "session_revocations" // Postgres NOTIFY channel of revoked session IDs
+	userEventsReplayMax  = 1000                  // Events returned on resume
+	userEventsBufferSize = 64                    // Events buffered for subscriber
+)
+
+// eventsHub fans out user events received from Postgres to subscribers of this replica
+type eventsHub struct {
+	m    sync.Mutex
+	subs map[string]map[chan UserEvent]struct{} // By user ID
+}
+
+func newEventsHub() *eventsHub {
+	return &eventsHub{subs: make(map[string]map[chan UserEvent]struct{})}
+}
+
+func (hub *eventsHub) subscribe(userID string) chan UserEvent {
+	hub.m.Lock()
+	defer hub.m.Unlock()
+	ch := make(chan UserEvent, userEventsBufferSize)
+	if hub.subs[userID] == nil {
+		hub.subs[userID] = make(map[chan UserEvent]struct{})
+	}
+	hub.subs[userID][ch] = struct{}{}
+	return ch
+}
+
+func (hub *eventsHub) unsubscribe(userID string, ch chan UserEvent) {
+	hub.m.Lock()
+	defer hub.m.Unlock()
+	hub.removeLocked(userID, ch)
+}
+
+func (hub *eventsHub) removeLocked(userID string, ch chan UserEvent) {
+	if _, ok := hub.subs[userID][ch]; !ok {
+		return
+	}
+	delete(hub.subs[userID], ch)
+	if len(hub.subs[userID]) == 0 {
+		delete(hub.subs, userID)
+	}
+	close(ch)
+}
+
+// publish sends event to subscribers of user. Subscriber, which fell behind, is dropped.
+func (hub *eventsHub) publish(e UserEvent) {
+	hub.m.Lock()
+	defer hub.m.Unlock()
+	for ch := range hub.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+			hub.removeLocked(e.UserID, ch)
+		}
+	}
+}
+
+// closeAll drops all subscribers, events could be lost
+func (hub *eventsHub) closeAll() {
+	hub.m.Lock()
+	defer hub.m.Unlock()
+	for userID, chans := range hub.subs {
+		for ch := range chans {
+			hub.removeLocked(userID, ch)
+		}
+	}
+}
+
+// SubscribeUserEvents returns channel of new events of user and function to unsubscribe. Channel is closed, if subscriber
+// falls behind or events connection is lost: subscriber should resume with GetUserEvents after last received event.
+func (s *Storage) SubscribeUserEvents(userID string) (<-chan UserEvent, func()) {
+	ch := s.events.subscribe(userID)
+	return ch, func() { s.events.unsubscribe(userID, ch) }
+}
+
+// GetUserEvents returns stored events of user after given event ID
+func (s *Storage) GetUserEvents(ctx context.Context, userID string, afterID int64) ([]UserEvent, error) {
+	query := `SELECT id, user_id, type, data FROM user_events WHERE user_id = $1 AND id > $2 ORDER BY id LIMIT $3`
+	rows, err := s.dbConn.Query(ctx, query, userID, afterID, userEventsReplayMax)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]UserEvent, 0)
+	for rows.Next() {
+		var e UserEvent
+		if err = rows.Scan(&e.ID, &e.UserID, &e.Type, &e.Data); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// addUserEventTx stores event and notifies all replicas on commit. Events of user are numbered in commit order:
+// user row is locked before id is taken, so concurrent transaction gets next id only after this one ends.
+// Subscribers and resume rely on it, as they skip events with id not greater than the last received one.
+func (s *Storage) addUserEventTx(ctx context.Context, tx pgx.Tx, userID string, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, "SELECT 1 FROM users WHERE id = $1 FOR NO KEY UPDATE", userID); err != nil {
+		return err
+	}
+	query := `WITH e AS (INSERT INTO user_events (user_id, type, data) VALUES ($1, $2, $3) RETURNING id, user_id, type, data)
+		SELECT pg_notify($4, json_build_object('id', id, 'user_id', user_id, 'type', type, 'data', data)::text) FROM e`
+	_, err = tx.Exec(ctx, query, userID, eventType, string(payload), userEventsChannel)
+	return err
+}
+
+// addOrderEventTx adds event with current state of order
+func (s *Storage) addOrderEventTx(ctx context.Context, tx pgx.Tx, userID string, orderNum string) error {
+	order, err := s.getOrderTx(ctx, tx, orderNum)
+	if err != nil {
+		return err
+	}
+	return s.addUserEventTx(ctx, tx, userID, UserEventOrder, order)
+}
+
+// addBalanceEventTx adds event with current balance of user
+func (s *Storage) addBalanceEventTx(ctx context.Context, tx pgx.Tx, userID string) error {
+	var balance, withdrawn, held int64
+	query := "SELECT balance, withdrawn, held FROM users WHERE id = $1"
+	if err := tx.QueryRow(ctx, query, userID).Scan(&balance, &withdrawn, &held); err != nil {
+		return err
+	}
+	curr := Numeric(balance - held)
+	with := Numeric(withdrawn)
+	hold := Numeric(held)
+	return s.addUserEventTx(ctx, tx, userID, UserEventBalance, BalanceInfo{Current: &curr, Withdrawn: &with, Held: &hold})
+}
+
+// PurgeUserEvents deletes events older than UserEventsTTL (0 - events are kept). Returns number of deleted events.
+func (s *Storage) PurgeUserEvents(ctx context.Context) (int, error) {
+	if s.config.UserEventsTTL <= 0 {
+		return 0, nil
+	}
+	query := "DELETE FROM user_events WHERE created_at < $1"
+	tag, err := s.dbConn.Exec(ctx, query, time.Now().Add(-s.config.UserEventsTTL))
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// eventsListen receives user events and session revocations of all replicas on dedicated connection. Events are
+// published to subscribers, revoked sessions are marked in session cache.
+func (s *Storage) eventsListen(ctx context.Context) {
+	defer func() { s.workersWg.Done() }()
+	reconnect := s.config.UserEventsReconnect
+	if reconnect <= 0 {
+		reconnect = 5 * time.Second
+	}
+	cw := utils.NewCtxCancelWaiter(ctx, 0)
+
+	for {
+		if cw.Scan() != nil {
+			s.events.closeAll()
+			s.logger.Info("eventsListen worker stopped")
+			return
+		}
+		err := s.listenUserEvents(ctx)
+		// Events sent while connection was lost are not received, subscribers resume from database
+		// and sessions are checked in database again
+		s.events.closeAll()
+		s.sessions.clear()
+		if ctx.Err() == nil {
+			s.logger.Sugar().Errorf("User events connection lost: %s", err.Error())
+			cw.SetTimeUntil(time.Now().Add(reconnect))
+		}
+	}
+}
+
+func (s *Storage) listenUserEvents(ctx context.Context) error {
+	pConn, err := s.dbConn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// Connection in LISTEN state is not returned to pool
+	conn := pConn.Hijack()
+	defer conn.Close(context.Background())
+
+	for _, channel := range []string{userEventsChannel, sessionsChannel} {
+		if _, err = conn.Exec(ctx, "LISTEN "+channel); err != nil {
+			return err
+		}
+	}
+	// Revocations made before LISTEN could be missed
+	s.sessions.clear()
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		if n.Channel == sessionsChannel {
+			s.sessions.set(n.Payload, true)
+			continue
+		}
+		var e UserEvent
+		if err = json.Unmarshal([]byte(n.Payload), &e); err != nil {
+			s.logger.Sugar().Errorf("Malformed user event %s: %s", n.Payload, err.Error())
+			continue
+		}
+		s.events.publish(e)
+	}
+}
+
+func (s *Storage) userEventsPurge(ctx context.Context) {
+	defer func() { s.workersWg.Done() }()
+	period := s.config.UserEventsPurgePeriod
+	if period <= 0 {
+		period = time.Hour
+	}
+	cw := utils.NewCtxCancelWaiter(ctx, period)
+
+	for {
+		if cw.Scan() != nil {
+			s.logger.Info("userEventsPurge worker stopped")
+			return
+		}
+		purged, err := s.PurgeUserEvents(ctx)
+		if err != nil {
+			s.logger.Sugar().Errorf("Unable to purge user events: %s", err.Error())
+			continue
+		}
+		if purged > 0 {
+			s.logger.Sugar().Infof("%d user events purged", purged)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"strings"
+	"time"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+// Hold statuses
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldVoided   = "voided"
+	HoldExpired  = "expired"
+)
+
+// CreateHold reserves points for order. Reserved points are excluded from available balance until hold is finished.
+func (s *Storage) CreateHold(ctx context.Context, userID string, orderNum string, sum Numeric, ttl time.Duration) (HoldInfo, error) {
+	if err := s.checkOrderNumber(orderNum); err != nil {
+		return HoldInfo{}, err
+	}
+
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return HoldInfo{}, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	if err = s.lockOrderPaymentTx(ctx, tx, orderNum); err != nil {
+		return HoldInfo{}, err
+	}
+	var paid bool
+	query := `SELECT EXISTS (SELECT 1 FROM withdrawals WHERE order_num = $1)`
+	if err = tx.QueryRow(ctx, query, orderNum).Scan(&paid); err != nil {
+		return HoldInfo{}, err
+	}
+	if paid {
+		return HoldInfo{}, ErrWithdrawalAlreadyExists
+	}
+
+	var (
+		holdID    string
+		createdAt time.Time
+		expiresAt time.Time
+	)
+	query = `INSERT INTO holds (user_id, order_num, sum, expires_at)
+		VALUES ($1, $2, $3, current_timestamp + $4 * interval '1 millisecond')
+		RETURNING id, created_at, expires_at`
+	err = tx.QueryRow(ctx, query, userID, orderNum, sum, ttl.Milliseconds()).Scan(&holdID, &createdAt, &expiresAt)
+	if err != nil {
+		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
+			return HoldInfo{}, fmt.Errorf("%s: %w", err.Error(), ErrHoldAlreadyExists)
+		}
+		return HoldInfo{}, err
+	}
+
+	query = `UPDATE users SET held = held + $2 WHERE id = $1`
+	if _, err = tx.Exec(ctx, query, userID, sum); err != nil {
+		if strings.Contains(err.Error(), pgerrcode.CheckViolation) {
+			return HoldInfo{}, ErrWithdrawNotEnough
+		}
+		return HoldInfo{}, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return HoldInfo{}, err
+	}
+	txOk = true
+
+	s.logger.Sugar().Infof("Hold %s: %s points for order %s until %s", holdID, &sum, orderNum, expiresAt.Format(time.RFC3339))
+	return HoldInfo{
+		ID:        holdID,
+		Order:     orderNum,
+		Sum:       &sum,
+		Status:    HoldActive,
+		CreatedAt: RFC3339Time(createdAt),
+		ExpiresAt: RFC3339Time(expiresAt),
+	}, nil
+}
+
+// lockOrderPaymentTx serializes holds and withdrawals of order number until transaction end, so hold and withdrawal
+// created concurrently do not miss each other
+func (s *Storage) lockOrderPaymentTx(ctx context.Context, tx pgx.Tx, orderNum string) error {
+	_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", "payment:"+orderNum)
+	return err
+}
+
+// finishHoldTx moves active hold of user to final status and releases its points. Must be called within transaction.
+func (s *Storage) finishHoldTx(ctx context.Context, tx pgx.Tx, userID string, holdID string, status string) (string, Numeric, error) {
+	var (
+		orderNum string
+		sum      Numeric
+	)
+	query := `UPDATE holds SET status = $3, finished_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND status = 'active' AND expires_at > NOW()
+		RETURNING order_num, sum`
+	err := tx.QueryRow(ctx, query, holdID, userID, status).Scan(&orderNum, &sum)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", 0, s.holdNotActiveReason(ctx, tx, userID, holdID)
+		}
+		if strings.Contains(err.Error(), pgerrcode.InvalidTextRepresentation) {
+			return "", 0, ErrHoldNotFound
+		}
+		return "", 0, err
+	}
+
+	query = `UPDATE users SET held = held - $2 WHERE id = $1`
+	if _, err = tx.Exec(ctx, query, userID, sum); err != nil {
+		return "", 0, err
+	}
+	return orderNum, sum, nil
+}
+
+func (s *Storage) holdNotActiveReason(ctx context.Context, tx pgx.Tx, userID string, holdID string) error {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM holds WHERE id = $1 AND user_id = $2)`
+	if err := tx.QueryRow(ctx, query, holdID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrHoldNotFound
+	}
+	return ErrHoldNotActive
+}
+
+// CaptureHold turns active hold into withdrawal
+func (s *Storage) CaptureHold(ctx context.Context, userID string, holdID string) error {
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	orderNum, sum, err := s.finishHoldTx(ctx, tx, userID, holdID, HoldCaptured)
+	if err != nil {
+		return err
+	}
+
+	withdrawalID, err := s.withdrawTx(ctx, tx, userID, orderNum, sum)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE holds SET withdrawal_id = $2 WHERE id = $1`
+	if _, err = tx.Exec(ctx, query, holdID, withdrawalID); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	txOk = true
+
+	s.logger.Sugar().Infof("Hold %s captured: %s points for order %s", holdID, &sum, orderNum)
+	return nil
+}
+
+// VoidHold releases points of active hold
+func (s *Storage) VoidHold(ctx context.Context, userID string, holdID string) error {
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	orderNum, sum, err := s.finishHoldTx(ctx, tx, userID, holdID, HoldVoided)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	txOk = true
+
+	s.logger.Sugar().Infof("Hold %s voided: %s points for order %s", holdID, &sum, orderNum)
+	return nil
+}
+
+// ExpireHolds releases points of expired holds. Returns number of expired holds.
+func (s *Storage) ExpireHolds(ctx context.Context) (int, error) {
+	query := `WITH e AS (
+			UPDATE holds SET status = 'expired', finished_at = NOW()
+			WHERE status = 'active' AND expires_at <= NOW()
+			RETURNING user_id, sum
+		), u AS (
+			UPDATE users SET held = held - r.sum
+			FROM (SELECT user_id, SUM(sum) AS sum FROM e GROUP BY user_id) r
+			WHERE users.id = r.user_id
+		)
+		SELECT COUNT(*) FROM e`
+	var expired int
+	err := s.dbConn.QueryRow(ctx, query).Scan(&expired)
+	return expired, err
+}
+
+func (s *Storage) holdsExpire(ctx context.Context) {
+	defer func() { s.workersWg.Done() }()
+	period := s.config.HoldExpirePeriod
+	if period <= 0 {
+		period = 30 * time.Second
+	}
+	cw := utils.NewCtxCancelWaiter(ctx, period)
+
+	for {
+		if cw.Scan() != nil {
+			s.logger.Info("holdsExpire worker stopped")
+			return
+		}
+		expired, err := s.ExpireHolds(ctx)
+		if err != nil {
+			s.logger.Sugar().Errorf("Unable to expire holds: %s", err.Error())
+			continue
+		}
+		if expired > 0 {
+			s.logger.Sugar().Infof("Holds expired: %d", expired)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// idempotent executes call in transaction, which also stores response, built by respond.
+// Concurrent request with the same key waits for the first one on INSERT and replays its response.
+// Responses with 5xx code are not stored, so request may be retried.
+func (s *Storage) idempotent(ctx context.Context, userID string, key IdempotencyKey,
+	call func(tx pgx.Tx) error, respond func(error) StoredResponse) (StoredResponse, bool, error) {
+
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return StoredResponse{}, false, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	// Expired keys of user are removed, so they may be reused
+	ttl := s.config.IdempotencyKeyTTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+	query := `DELETE FROM idempotency_keys WHERE user_id = $1 AND created_at < NOW() - $2 * interval '1 millisecond'`
+	if _, err = tx.Exec(ctx, query, userID, ttl.Milliseconds()); err != nil {
+		return StoredResponse{}, false, err
+	}
+
+	query = `INSERT INTO idempotency_keys (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`
+	tag, err := tx.Exec(ctx, query, userID, key.Key, key.RequestHash)
+	if err != nil {
+		return StoredResponse{}, false, err
+	}
+	if tag.RowsAffected() == 0 {
+		var requestHash string
+		var resp StoredResponse
+		query = `SELECT request_hash, status_code, response FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+		err = tx.QueryRow(ctx, query, userID, key.Key).Scan(&requestHash, &resp.StatusCode, &resp.Body)
+		if err != nil {
+			return StoredResponse{}, false, err
+		}
+		if requestHash != key.RequestHash {
+			return StoredResponse{}, false, ErrIdempotencyKeyReused
+		}
+		return resp, true, nil
+	}
+
+	// Savepoint: failed call must not abort transaction, its response is stored too
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return StoredResponse{}, false, err
+	}
+	if err = call(sp); err == nil {
+		err = sp.Commit(ctx)
+	} else {
+		sp.Rollback(ctx)
+	}
+
+	resp := respond(err)
+	if resp.StatusCode >= 500 {
+		return resp, false, nil
+	}
+
+	query = `UPDATE idempotency_keys SET status_code = $3, response = $4 WHERE user_id = $1 AND key = $2`
+	if _, err = tx.Exec(ctx, query, userID, key.Key, resp.StatusCode, resp.Body); err != nil {
+		return StoredResponse{}, false, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return StoredResponse{}, false, err
+	}
+	txOk = true
+
+	return resp, false, nil
+}
+
+// WithdrawIdempotent: Withdraw, which is executed once per idempotency key. Returns stored response and replay flag.
+func (s *Storage) WithdrawIdempotent(ctx context.Context, userID string, key IdempotencyKey,
+	orderNum string, sum Numeric, respond func(error) StoredResponse) (StoredResponse, bool, error) {
+	return s.idempotent(ctx, userID, key, func(tx pgx.Tx) error {
+		_, err := s.withdrawTx(ctx, tx, userID, orderNum, sum)
+		return err
+	}, respond)
+}
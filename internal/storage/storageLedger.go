@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"time"
+)
+
+// Ledger entry kinds
+const (
+	LedgerAccrual     = "accrual"
+	LedgerBonus       = "bonus"    // Loyalty tier bonus on top of accrual
+	LedgerCampaign    = "campaign" // Promotional campaign bonus, one entry per campaign
+	LedgerReferral    = "referral"
+	LedgerWithdrawal  = "withdrawal"
+	LedgerReversal    = "reversal"
+	LedgerAdjustment  = "adjustment"
+	LedgerExpiration  = "expiration"
+	LedgerTransferOut = "transfer_out"
+	LedgerTransferIn  = "transfer_in"
+)
+
+// Counter accounts of ledger entries
+const (
+	AccountAccrual     = "system:accrual"
+	AccountBonus       = "system:bonus"
+	AccountCampaigns   = "system:campaigns"
+	AccountReferrals   = "system:referrals"
+	AccountWithdrawals = "system:withdrawals"
+	AccountAdjustments = "system:adjustments"
+	AccountDebt        = "system:debt" // Repayment of clawback debt
+	AccountExpired     = "system:expired"
+)
+
+type ledgerEntry struct {
+	UserID         string
+	Kind           string
+	Amount         Numeric // Signed change of user balance
+	CounterAccount string
+	OrderNum       string
+	WithdrawalID   string
+	Lots           []lotSlice // Credit only: points, which keep earned_at of lots they come from
+}
+
+// withdrawnDelta returns change of users.withdrawn caused by entry
+func (le ledgerEntry) withdrawnDelta() Numeric {
+	switch le.Kind {
+	case LedgerWithdrawal, LedgerReversal:
+		return -le.Amount
+	default:
+		return 0
+	}
+}
+
+// postLedger appends ledger entry and applies it to users balance snapshot and point lots. Must be called within transaction.
+func (s *Storage) postLedger(ctx context.Context, tx pgx.Tx, entry ledgerEntry) error {
+	_, err := s.postLedgerLots(ctx, tx, entry)
+	return err
+}
+
+// postLedgerLots posts entry as postLedger does and returns lots consumed by debit
+func (s *Storage) postLedgerLots(ctx context.Context, tx pgx.Tx, entry ledgerEntry) ([]lotSlice, error) {
+	// User row is locked first: it serializes all balance changes of user, including lots consumption
+	query := "UPDATE users SET balance = balance + $2, withdrawn = withdrawn + $3 WHERE id = $1"
+	_, err := tx.Exec(ctx, query, entry.UserID, entry.Amount, entry.withdrawnDelta())
+	if err != nil {
+		return nil, err
+	}
+
+	var entryID int64
+	query = `INSERT INTO ledger_entries (user_id, kind, amount, counter_account, order_num, withdrawal_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')::uuid) RETURNING id`
+	err = tx.QueryRow(ctx, query, entry.UserID, entry.Kind, entry.Amount, entry.CounterAccount, entry.OrderNum, entry.WithdrawalID).Scan(&entryID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case entry.Amount > 0:
+		return nil, s.addLotTx(ctx, tx, entry, entryID)
+	case entry.Amount < 0:
+		consumed, err := s.consumeLotsTx(ctx, tx, entry.UserID, -entry.Amount)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Kind == LedgerWithdrawal {
+			if err = s.addLotDebitsTx(ctx, tx, entryID, consumed); err != nil {
+				return nil, err
+			}
+		}
+		return consumed, nil
+	}
+	return nil, nil
+}
+
+func (s *Storage) GetBalanceHistory(ctx context.Context, userID string) (LedgerInfo, error) {
+	// Counterparty is resolved for transfers only
+	query := `SELECT l.kind, l.amount, (SUM(l.amount) OVER (ORDER BY l.created_at, l.id))::bigint, l.order_num, u.login, l.created_at
+		FROM ledger_entries l
+		LEFT JOIN users u ON l.counter_account = 'user:' || u.id::text
+		WHERE l.user_id = $1 ORDER BY l.created_at, l.id`
+	rows, err := s.dbConn.Query(ctx, query, userID)
+	if err != nil {
+		s.logger.Sugar().Errorf(err.Error())
+		return LedgerInfo{}, err
+	}
+	defer rows.Close()
+
+	entries := make([]LedgerEntryInfo, 0)
+	for rows.Next() {
+		var (
+			eKind      string
+			eAmount    Numeric
+			eBalance   Numeric
+			eOrderNum  pgtype.Text
+			eLogin     pgtype.Text
+			eCreatedAt time.Time
+		)
+		if err = rows.Scan(&eKind, &eAmount, &eBalance, &eOrderNum, &eLogin, &eCreatedAt); err != nil {
+			s.logger.Sugar().Errorf("Query %s, %s", query, err.Error())
+			return LedgerInfo{}, err
+		}
+		entries = append(entries, LedgerEntryInfo{
+			Kind:         eKind,
+			Amount:       &eAmount,
+			Balance:      &eBalance,
+			Order:        eOrderNum.String,
+			Counterparty: eLogin.String,
+			CreatedAt:    RFC3339Time(eCreatedAt),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return LedgerInfo{}, err
+	}
+
+	return LedgerInfo{Entries: entries}, nil
+}
+
+// VerifyLedger returns IDs of users, whose balance snapshot differs from their ledger, point lots, active holds or clawback debts
+func (s *Storage) VerifyLedger(ctx context.Context) ([]string, error) {
+	query := `SELECT u.id FROM users u
+		LEFT JOIN (
+			SELECT user_id,
+				SUM(amount) AS balance,
+				SUM(CASE WHEN kind IN ($1, $2) THEN -amount ELSE 0 END) AS withdrawn
+			FROM ledger_entries GROUP BY user_id
+		) l ON l.user_id = u.id
+		LEFT JOIN (
+			SELECT user_id, SUM(sum) AS held FROM holds WHERE status = 'active' GROUP BY user_id
+		) h ON h.user_id = u.id
+		LEFT JOIN (
+			SELECT user_id, SUM(debt) AS debt FROM accrual_adjustments GROUP BY user_id
+		) d ON d.user_id = u.id
+		LEFT JOIN (
+			SELECT user_id, SUM(-amount) AS repaid FROM ledger_entries WHERE counter_account = $3 GROUP BY user_id
+		) r ON r.user_id = u.id
+		LEFT JOIN (
+			SELECT user_id, SUM(remaining) AS remaining FROM point_lots GROUP BY user_id
+		) p ON p.user_id = u.id
+		WHERE u.balance <> COALESCE(l.balance, 0) OR u.withdrawn <> COALESCE(l.withdrawn, 0)
+			OR u.balance <> COALESCE(p.remaining, 0)
+			OR u.held <> COALESCE(h.held, 0) OR u.debt <> COALESCE(d.debt, 0) - COALESCE(r.repaid, 0)`
+	rows, err := s.dbConn.Query(ctx, query, LedgerWithdrawal, LedgerReversal, AccountDebt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatched := make([]string, 0)
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		mismatched = append(mismatched, userID)
+	}
+	return mismatched, rows.Err()
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgtype"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxListLimit: largest page of orders or withdrawals list
+const MaxListLimit = 1000
+
+// listCursor: position after last row of page. Sort order is included, so cursor can not be used with other one.
+type listCursor struct {
+	SortBy string    `json:"s"`
+	Desc   bool      `json:"d,omitempty"`
+	At     time.Time `json:"t"`
+	ID     string    `json:"id"`
+}
+
+func (c listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(cursor string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return c, fmt.Errorf("malformed cursor: %w", ErrListQueryInvalid)
+	}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("malformed cursor: %w", ErrListQueryInvalid)
+	}
+	// ID is compared with uuid column, database would reject the query
+	var id pgtype.UUID
+	if err = id.Scan(c.ID); err != nil {
+		return c, fmt.Errorf("malformed cursor: %w", ErrListQueryInvalid)
+	}
+	return c, nil
+}
+
+// listSQL builds WHERE, ORDER BY and LIMIT of keyset paginated query
+type listSQL struct {
+	where []string
+	args  []any
+}
+
+func (b *listSQL) arg(v any) string {
+	b.args = append(b.args, v)
+	return "$" + strconv.Itoa(len(b.args))
+}
+
+// page adds bounds, cursor, sort and limit of query. Sort field is a column of table alias t.
+func (b *listSQL) page(q ListQuery) (string, error) {
+	if q.Limit < 0 || q.Limit > MaxListLimit {
+		return "", fmt.Errorf("limit must be from 1 to %d: %w", MaxListLimit, ErrListQueryInvalid)
+	}
+	col := "t." + q.SortBy
+	if !q.From.IsZero() {
+		b.where = append(b.where, col+" >= "+b.arg(q.From))
+	}
+	if !q.To.IsZero() {
+		b.where = append(b.where, col+" < "+b.arg(q.To))
+	}
+
+	cmp, dir := ">", "ASC"
+	if q.Desc {
+		cmp, dir = "<", "DESC"
+	}
+	if q.Cursor != "" {
+		c, err := decodeListCursor(q.Cursor)
+		if err != nil {
+			return "", err
+		}
+		if c.SortBy != q.SortBy || c.Desc != q.Desc {
+			return "", fmt.Errorf("cursor was issued for other sort order: %w", ErrListQueryInvalid)
+		}
+		b.where = append(b.where, fmt.Sprintf("(%s, t.id) %s (%s, %s)", col, cmp, b.arg(c.At), b.arg(c.ID)))
+	}
+
+	res := " WHERE " + strings.Join(b.where, " AND ") + fmt.Sprintf(" ORDER BY %s %s, t.id %s", col, dir, dir)
+	if q.Limit > 0 {
+		// One more row tells if there is next page
+		res += " LIMIT " + b.arg(q.Limit+1)
+	}
+	return res, nil
+}
+
+// nextCursor returns cursor of page next to rows fetched by listSQL and trims extra row
+func nextCursor[T any](q ListQuery, rows []T, key func(T) (time.Time, string)) ([]T, string) {
+	if q.Limit == 0 || len(rows) <= q.Limit {
+		return rows, ""
+	}
+	rows = rows[:q.Limit]
+	at, id := key(rows[q.Limit-1])
+	return rows, listCursor{SortBy: q.SortBy, Desc: q.Desc, At: at, ID: id}.encode()
+}
+
+var orderStatuses = map[string]OrderStatus{
+	"NEW":        StatusNew,
+	"PROCESSING": StatusProcessing,
+	"INVALID":    StatusInvalid,
+	"PROCESSED":  StatusProcessed,
+}
+
+// GetOrdersPage returns page of user orders, by default sorted by upload time
+func (s *Storage) GetOrdersPage(ctx context.Context, userID string, q ListQuery) (OrdersInfo, error) {
+	if q.SortBy == "" {
+		q.SortBy = SortUploadedAt
+	}
+	b := &listSQL{}
+	b.where = append(b.where, "t.user_id = "+b.arg(userID))
+	switch q.SortBy {
+	case SortUploadedAt:
+	case SortProcessedAt:
+		b.where = append(b.where, "t.processed_at IS NOT NULL")
+	default:
+		return OrdersInfo{}, fmt.Errorf("unknown sort field %q: %w", q.SortBy, ErrListQueryInvalid)
+	}
+	if len(q.Statuses) > 0 {
+		statuses := make([]int16, 0, len(q.Statuses))
+		for _, name := range q.Statuses {
+			status, ok := orderStatuses[strings.ToUpper(name)]
+			if !ok {
+				return OrdersInfo{}, fmt.Errorf("unknown order status %q: %w", name, ErrListQueryInvalid)
+			}
+			statuses = append(statuses, int16(status))
+		}
+		b.where = append(b.where, "t.status = ANY("+b.arg(statuses)+")")
+	}
+	page, err := b.page(q)
+	if err != nil {
+		return OrdersInfo{}, err
+	}
+
+	query := `SELECT t.id, t.order_num, t.status, t.accrual, t.bonus, t.uploaded_at, t.processed_at FROM orders t` + page
+	rows, err := s.dbConn.Query(ctx, query, b.args...)
+	if err != nil {
+		s.logger.Sugar().Errorf(err.Error())
+		return OrdersInfo{}, err
+	}
+	defer rows.Close()
+
+	res, err := s.getOrdersFromRequest(rows, query)
+	if err != nil {
+		return OrdersInfo{}, err
+	}
+	res.Orders, res.NextCursor = nextCursor(q, res.Orders, func(o OrderInfo) (time.Time, string) {
+		if q.SortBy == SortProcessedAt {
+			return time.Time(*o.ProcessedAt), o.id
+		}
+		return time.Time(o.UploadedAt), o.id
+	})
+	return res, nil
+}
+
+// GetWithdrawalsPage returns page of user withdrawals sorted by processing time
+func (s *Storage) GetWithdrawalsPage(ctx context.Context, userID string, q ListQuery) (WithdrawalsInfo, error) {
+	if q.SortBy == "" {
+		q.SortBy = SortProcessedAt
+	}
+	if q.SortBy != SortProcessedAt {
+		return WithdrawalsInfo{}, fmt.Errorf("unknown sort field %q: %w", q.SortBy, ErrListQueryInvalid)
+	}
+	b := &listSQL{}
+	b.where = append(b.where, "t.user_id = "+b.arg(userID))
+	if len(q.Statuses) > 0 {
+		conds := make([]string, 0, len(q.Statuses))
+		for _, name := range q.Statuses {
+			switch strings.ToUpper(name) {
+			case WithdrawalCompleted:
+				conds = append(conds, "t.reversed = 0")
+			case WithdrawalPartiallyReversed:
+				conds = append(conds, "(t.reversed > 0 AND t.reversed < t.sum)")
+			case WithdrawalReversed:
+				conds = append(conds, "t.reversed >= t.sum")
+			default:
+				return WithdrawalsInfo{}, fmt.Errorf("unknown withdrawal status %q: %w", name, ErrListQueryInvalid)
+			}
+		}
+		b.where = append(b.where, "("+strings.Join(conds, " OR ")+")")
+	}
+	page, err := b.page(q)
+	if err != nil {
+		return WithdrawalsInfo{}, err
+	}
+
+	query := `SELECT t.id, t.order_num, t.sum, t.reversed, t.processed_at FROM withdrawals t` + page
+	rows, err := s.dbConn.Query(ctx, query, b.args...)
+	if err != nil {
+		s.logger.Sugar().Errorf(err.Error())
+		return WithdrawalsInfo{}, err
+	}
+	defer rows.Close()
+
+	withdrawals := make([]WithdrawalInfo, 0)
+	for rows.Next() {
+		var (
+			oNumber      string
+			oSum         Numeric
+			oReversed    Numeric
+			oProcessedAt time.Time
+		)
+		info := WithdrawalInfo{}
+		err := rows.Scan(&info.id, &oNumber, &oSum, &oReversed, &oProcessedAt)
+		if err != nil {
+			s.logger.Sugar().Errorf("Query %s, %s", query, err.Error())
+			return WithdrawalsInfo{}, err
+		}
+		info.Order = oNumber
+		info.Sum = &oSum
+		info.ProcessedAt = RFC3339Time(oProcessedAt)
+		info.Status = withdrawalStatus(oSum, oReversed)
+		if oReversed > 0 {
+			info.Reversed = &oReversed
+		}
+		withdrawals = append(withdrawals, info)
+	}
+	if err = rows.Err(); err != nil {
+		return WithdrawalsInfo{}, err
+	}
+
+	res := WithdrawalsInfo{}
+	res.Withdrawals, res.NextCursor = nextCursor(q, withdrawals, func(w WithdrawalInfo) (time.Time, string) {
+		return time.Time(w.ProcessedAt), w.id
+	})
+	return res, nil
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"encoding/base64"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDecodeListCursor(t *testing.T) {
+	valid := listCursor{SortBy: "uploaded_at", At: time.Now().UTC(), ID: "6f1c1b7e-3c1a-4c55-9d3c-0d2a4f0b6e11"}
+	c, err := decodeListCursor(valid.encode())
+	require.NoError(t, err)
+	assert.Equal(t, valid.ID, c.ID)
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "Not base64", cursor: "!!!"},
+		{name: "Not JSON", cursor: base64.RawURLEncoding.EncodeToString([]byte("{"))},
+		{name: "Empty ID", cursor: listCursor{SortBy: "uploaded_at"}.encode()},
+		{name: "ID is not UUID", cursor: listCursor{SortBy: "uploaded_at", ID: "1' OR '1'='1"}.encode()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeListCursor(tt.cursor)
+			assert.ErrorIs(t, err, ErrListQueryInvalid)
+		})
+	}
+}
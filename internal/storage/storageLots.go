@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"time"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+const (
+	expirePointsPage = 1000                                   // Users processed per query of ExpirePoints
+	uuidMin          = "00000000-0000-0000-0000-000000000000" // Start of users pages
+)
+
+// lotSlice: points of one lot, moved by debit or credit
+type lotSlice struct {
+	Amount   Numeric
+	EarnedAt time.Time
+}
+
+// addLotTx creates lots of credited points. Points, which come back from other lots (entry.Lots), keep their earned_at,
+// so they are not renewed by transfers and reversals; the rest is earned now. Must be called within transaction.
+func (s *Storage) addLotTx(ctx context.Context, tx pgx.Tx, entry ledgerEntry, entryID int64) error {
+	rest := entry.Amount
+	if len(entry.Lots) > 0 {
+		amounts := make([]int64, 0, len(entry.Lots))
+		earned := make([]time.Time, 0, len(entry.Lots))
+		for _, v := range entry.Lots {
+			amount := min(v.Amount, rest)
+			if amount <= 0 {
+				break
+			}
+			amounts = append(amounts, int64(amount))
+			earned = append(earned, v.EarnedAt)
+			rest -= amount
+		}
+		query := `INSERT INTO point_lots (user_id, ledger_entry_id, order_num, amount, remaining, earned_at)
+			SELECT $1, $2, NULLIF($3, ''), l.amount, l.amount, l.earned_at
+			FROM unnest($4::bigint[], $5::timestamptz[]) AS l(amount, earned_at)`
+		if _, err := tx.Exec(ctx, query, entry.UserID, entryID, entry.OrderNum, amounts, earned); err != nil {
+			return err
+		}
+	}
+	if rest <= 0 {
+		return nil
+	}
+
+	query := `INSERT INTO point_lots (user_id, ledger_entry_id, order_num, amount, remaining)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $4)`
+	_, err := tx.Exec(ctx, query, entry.UserID, entryID, entry.OrderNum, rest)
+	return err
+}
+
+// consumeLotsTx consumes lots of user in FIFO order and returns consumed parts, oldest first.
+// Must be called within transaction, after user row is locked.
+func (s *Storage) consumeLotsTx(ctx context.Context, tx pgx.Tx, userID string, amount Numeric) ([]lotSlice, error) {
+	query := `WITH c AS (
+			SELECT id, remaining, earned_at, (SUM(remaining) OVER (ORDER BY earned_at, id))::bigint - remaining AS before
+			FROM point_lots WHERE user_id = $1 AND remaining > 0
+		), u AS (
+			UPDATE point_lots p SET remaining = p.remaining - LEAST(c.remaining, $2::bigint - c.before)
+			FROM c WHERE p.id = c.id AND c.before < $2::bigint
+			RETURNING LEAST(c.remaining, $2::bigint - c.before) AS consumed, c.earned_at, c.id
+		)
+		SELECT consumed, earned_at FROM u ORDER BY earned_at, id`
+	slices, consumed, err := collectLotSlices(tx.Query(ctx, query, userID, amount))
+	if err != nil {
+		return nil, err
+	}
+	if consumed != amount {
+		// Balance is checked by constraint, so it is only possible if lots differ from balance
+		s.logger.Sugar().Warnf("Point lots of user %s do not cover debit: %s of %s consumed", userID, &consumed, &amount)
+	}
+	return slices, nil
+}
+
+func collectLotSlices(rows pgx.Rows, err error) ([]lotSlice, Numeric, error) {
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var total Numeric
+	slices := make([]lotSlice, 0)
+	for rows.Next() {
+		var v lotSlice
+		if err = rows.Scan(&v.Amount, &v.EarnedAt); err != nil {
+			return nil, 0, err
+		}
+		total += v.Amount
+		slices = append(slices, v)
+	}
+	return slices, total, rows.Err()
+}
+
+// addLotDebitsTx records lots consumed by withdrawal entry, so reversal can restore them
+func (s *Storage) addLotDebitsTx(ctx context.Context, tx pgx.Tx, entryID int64, slices []lotSlice) error {
+	if len(slices) == 0 {
+		return nil
+	}
+	amounts := make([]int64, 0, len(slices))
+	earned := make([]time.Time, 0, len(slices))
+	for _, v := range slices {
+		amounts = append(amounts, int64(v.Amount))
+		earned = append(earned, v.EarnedAt)
+	}
+	query := `INSERT INTO point_lot_debits (ledger_entry_id, amount, earned_at)
+		SELECT $1, l.amount, l.earned_at FROM unnest($2::bigint[], $3::timestamptz[]) AS l(amount, earned_at)`
+	_, err := tx.Exec(ctx, query, entryID, amounts, earned)
+	return err
+}
+
+// restoreLotsTx returns lots consumed by withdrawal, which are refunded by reversal of amount, oldest first.
+// Must be called within transaction, after withdrawal row is locked.
+func (s *Storage) restoreLotsTx(ctx context.Context, tx pgx.Tx, withdrawalID string, amount Numeric) ([]lotSlice, error) {
+	query := `WITH d AS (
+			SELECT d.id, d.amount - d.restored AS unrestored, d.earned_at,
+				(SUM(d.amount - d.restored) OVER (ORDER BY d.earned_at, d.id))::bigint - (d.amount - d.restored) AS before
+			FROM point_lot_debits d JOIN ledger_entries l ON l.id = d.ledger_entry_id
+			WHERE l.withdrawal_id = $1 AND l.kind = $3 AND d.restored < d.amount
+		), u AS (
+			UPDATE point_lot_debits p SET restored = p.restored + LEAST(d.unrestored, $2::bigint - d.before)
+			FROM d WHERE p.id = d.id AND d.before < $2::bigint
+			RETURNING LEAST(d.unrestored, $2::bigint - d.before) AS restored, d.earned_at, d.id
+		)
+		SELECT restored, earned_at FROM u ORDER BY earned_at, id`
+	slices, restored, err := collectLotSlices(tx.Query(ctx, query, withdrawalID, amount, LedgerWithdrawal))
+	if err != nil {
+		return nil, err
+	}
+	if restored < amount {
+		// Consumed lots of withdrawal are not recorded: points were earned before withdrawal at the latest
+		var withdrawnAt time.Time
+		query = `SELECT COALESCE(MIN(created_at), NOW()) FROM ledger_entries WHERE withdrawal_id = $1 AND kind = $2`
+		if err = tx.QueryRow(ctx, query, withdrawalID, LedgerWithdrawal).Scan(&withdrawnAt); err != nil {
+			return nil, err
+		}
+		slices = append(slices, lotSlice{Amount: amount - restored, EarnedAt: withdrawnAt})
+	}
+	return slices, nil
+}
+
+// pointsTTLMonths returns points lifetime in months, zero if points do not expire
+func (s *Storage) pointsTTLMonths() int {
+	return max(s.config.PointsTTLMonths, 0)
+}
+
+// ExpirePoints writes off points of expired lots. Points reserved by holds are written off after hold is finished.
+// Returns number of users, whose points were expired.
+func (s *Storage) ExpirePoints(ctx context.Context) (int, error) {
+	months := s.pointsTTLMonths()
+	if months == 0 {
+		return 0, nil
+	}
+
+	// Users, whose expired points are all held, are skipped until holds are finished. Pages are ordered by user ID,
+	// so every user is visited once per run.
+	query := `SELECT p.user_id FROM point_lots p JOIN users u ON u.id = p.user_id
+		WHERE p.remaining > 0 AND p.earned_at <= NOW() - make_interval(months => $1)
+			AND u.balance - u.held > 0 AND p.user_id > $2::uuid
+		GROUP BY p.user_id
+		ORDER BY p.user_id
+		LIMIT $3`
+	expired := 0
+	after := uuidMin
+	for {
+		rows, err := s.dbConn.Query(ctx, query, months, after, expirePointsPage)
+		if err != nil {
+			return expired, err
+		}
+		userIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return expired, err
+		}
+
+		for _, userID := range userIDs {
+			amount, err := s.expireUserPoints(ctx, userID, months)
+			if err != nil {
+				return expired, err
+			}
+			if amount > 0 {
+				expired++
+				s.logger.Sugar().Infof("Points of user %s expired: %s", userID, &amount)
+			}
+		}
+		if len(userIDs) < expirePointsPage {
+			return expired, nil
+		}
+		after = userIDs[len(userIDs)-1]
+	}
+}
+
+func (s *Storage) expireUserPoints(ctx context.Context, userID string, months int) (Numeric, error) {
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var available Numeric
+	query := `SELECT balance - held FROM users WHERE id = $1 FOR UPDATE`
+	if err = tx.QueryRow(ctx, query, userID).Scan(&available); err != nil {
+		return 0, err
+	}
+
+	var expired Numeric
+	query = `SELECT COALESCE(SUM(remaining), 0)::bigint FROM point_lots
+		WHERE user_id = $1 AND remaining > 0 AND earned_at <= NOW() - make_interval(months => $2)`
+	if err = tx.QueryRow(ctx, query, userID, months).Scan(&expired); err != nil {
+		return 0, err
+	}
+
+	// Expired lots are the oldest ones, so they are consumed first
+	amount := min(expired, available)
+	if amount > 0 {
+		err = s.postLedger(ctx, tx, ledgerEntry{
+			UserID:         userID,
+			Kind:           LedgerExpiration,
+			Amount:         -amount,
+			CounterAccount: AccountExpired,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	txOk = true
+
+	return max(amount, 0), nil
+}
+
+// getExpiringSoon returns points of user, which expire within ExpiringSoonWindow, grouped by day
+func (s *Storage) getExpiringSoon(ctx context.Context, userID string) ([]ExpiringPointsInfo, error) {
+	months := s.pointsTTLMonths()
+	if months == 0 {
+		return nil, nil
+	}
+	window := s.config.ExpiringSoonWindow
+	if window <= 0 {
+		window = 30 * 24 * time.Hour
+	}
+
+	query := `SELECT SUM(remaining)::bigint, MIN(earned_at) + make_interval(months => $2)
+		FROM point_lots
+		WHERE user_id = $1 AND remaining > 0
+			AND earned_at + make_interval(months => $2) <= NOW() + $3 * interval '1 millisecond'
+		GROUP BY (earned_at AT TIME ZONE 'UTC')::date
+		ORDER BY 2`
+	rows, err := s.dbConn.Query(ctx, query, userID, months, window.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]ExpiringPointsInfo, 0)
+	for rows.Next() {
+		var (
+			amount    Numeric
+			expiresAt time.Time
+		)
+		if err = rows.Scan(&amount, &expiresAt); err != nil {
+			return nil, err
+		}
+		res = append(res, ExpiringPointsInfo{Amount: &amount, ExpiresAt: RFC3339Time(expiresAt)})
+	}
+	return res, rows.Err()
+}
+
+func (s *Storage) pointsExpire(ctx context.Context) {
+	defer func() { s.workersWg.Done() }()
+	period := s.config.PointsExpirePeriod
+	if period <= 0 {
+		period = time.Hour
+	}
+	cw := utils.NewCtxCancelWaiter(ctx, period)
+
+	for {
+		if cw.Scan() != nil {
+			s.logger.Info("pointsExpire worker stopped")
+			return
+		}
+		expired, err := s.ExpirePoints(ctx)
+		if err != nil {
+			s.logger.Sugar().Errorf("Unable to expire points: %s", err.Error())
+			continue
+		}
+		if expired > 0 {
+			s.logger.Sugar().Infof("Points of %d users expired", expired)
+		}
+	}
+}
@@ -12,13 +12,24 @@ import (
 	"yapracticum-go-diploma-1/internal/utils"
 )
 
-func (s *Storage) OrderAddNew(ctx context.Context, userID string, orderNum string) error {
+// checkOrderNumber validates order number of uploaded order or withdrawal
+func (s *Storage) checkOrderNumber(orderNum string) error {
 	oNum, err := strconv.Atoi(orderNum)
-	if err != nil || (!utils.LuhnValid(int(oNum)) && s.config.UseLuhn) {
+	if err != nil || oNum < 0 || (!utils.LuhnValid(oNum) && s.config.UseLuhn) {
 		return ErrOrderLuhnCheckFailed
 	}
+	return nil
+}
+
+func (s *Storage) OrderAddNew(ctx context.Context, userID string, orderNum string) error {
+	err := s.checkOrderNumber(orderNum)
+	if err != nil {
+		return err
+	}
 
-	query := `INSERT INTO orders (user_id, order_num) VALUES ($1, $2)`
+	// Order and its accrual job are created atomically
+	query := `WITH o AS (INSERT INTO orders (user_id, order_num) VALUES ($1, $2) RETURNING order_num)
+		INSERT INTO accrual_jobs (order_num) SELECT order_num FROM o`
 
 	_, err = s.dbConn.Exec(ctx, query, userID, orderNum)
 	if err != nil {
@@ -36,53 +47,135 @@ func (s *Storage) OrderAddNew(ctx context.Context, userID string, orderNum strin
 		return err
 	}
 
-	select {
-	case s.newOrdersCh <- OrderTag{OrderNum: orderNum, PollAfter: time.Now(), IssuedAt: time.Now()}:
-	default:
-		s.logger.Sugar().Warnf("Order %s processing is delayed due to high load", orderNum)
-	}
+	s.notifyAccrualJob(orderNum, time.Now())
 
 	return nil
 }
 
-func (s *Storage) GetOrdersData(ctx context.Context, userID string) (OrdersInfo, error) {
-	query := `SELECT order_num, status, accrual, uploaded_at FROM orders WHERE user_id = $1`
-	rows, err := s.dbConn.Query(ctx, query, userID)
+// OrderAddBatch uploads orders of user in one query and returns status of each order in the same order.
+// Orders, which passed validation, are inserted along with their accrual jobs, existing ones are skipped.
+func (s *Storage) OrderAddBatch(ctx context.Context, userID string, orderNums []string) ([]BatchOrderResult, error) {
+	if limit := s.config.BatchOrdersMax; limit > 0 && len(orderNums) > limit {
+		return nil, fmt.Errorf("%d orders, limit is %d: %w", len(orderNums), limit, ErrBatchTooLarge)
+	}
+
+	res := make([]BatchOrderResult, len(orderNums))
+	valid := make([]string, 0, len(orderNums))
+	for i, orderNum := range orderNums {
+		res[i] = BatchOrderResult{Number: orderNum, Status: BatchOrderInvalid}
+		if s.checkOrderNumber(orderNum) == nil {
+			valid = append(valid, orderNum)
+		}
+	}
+	if len(valid) == 0 {
+		return res, nil
+	}
+
+	// Outer SELECT sees orders as they were before insert, so owner of skipped order is found by join.
+	// Order inserted by concurrent request is not seen at all and is reported as other user's one.
+	query := `WITH input AS (SELECT DISTINCT unnest($2::text[]) AS order_num),
+		ins AS (INSERT INTO orders (user_id, order_num) SELECT $1, order_num FROM input
+			ON CONFLICT (order_num) DO NOTHING RETURNING order_num),
+		jobs AS (INSERT INTO accrual_jobs (order_num) SELECT order_num FROM ins)
+		SELECT i.order_num, CASE
+			WHEN ins.order_num IS NOT NULL THEN $3
+			WHEN o.user_id = $1 THEN $4
+			ELSE $5 END
+		FROM input i
+		LEFT JOIN ins ON ins.order_num = i.order_num
+		LEFT JOIN orders o ON o.order_num = i.order_num`
+	rows, err := s.dbConn.Query(ctx, query, userID, valid, BatchOrderAccepted, BatchOrderAlreadyUploaded, BatchOrderOtherUser)
 	if err != nil {
 		s.logger.Sugar().Errorf(err.Error())
-		return OrdersInfo{}, err
+		return nil, err
 	}
-	return s.getOrdersFromRequest(rows, query)
+	defer rows.Close()
+
+	statuses := make(map[string]string, len(valid))
+	for rows.Next() {
+		var orderNum, status string
+		if err = rows.Scan(&orderNum, &status); err != nil {
+			s.logger.Sugar().Errorf("Query: %s, %s", query, err.Error())
+			return nil, err
+		}
+		statuses[orderNum] = status
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range res {
+		status, ok := statuses[res[i].Number]
+		if !ok {
+			continue
+		}
+		if status == BatchOrderAccepted {
+			s.notifyAccrualJob(res[i].Number, now)
+			// Repeated number in batch is not accepted twice
+			statuses[res[i].Number] = BatchOrderAlreadyUploaded
+		}
+		res[i].Status = status
+	}
+	return res, nil
+}
+
+// GetOrdersData returns all user orders sorted by upload time
+func (s *Storage) GetOrdersData(ctx context.Context, userID string) (OrdersInfo, error) {
+	return s.GetOrdersPage(ctx, userID, ListQuery{})
 }
 
-func (s *Storage) GetUnhandledOrders(ctx context.Context) (OrdersInfo, error) {
-	query := `SELECT order_num, status, accrual, uploaded_at FROM orders	WHERE status NOT IN ($1, $2)`
-	rows, err := s.dbConn.Query(ctx, query, StatusInvalid, StatusProcessed)
+// getOrderTx returns current state of order within transaction
+func (s *Storage) getOrderTx(ctx context.Context, tx pgx.Tx, orderNum string) (OrderInfo, error) {
+	query := `SELECT id, order_num, status, accrual, bonus, uploaded_at, processed_at FROM orders WHERE order_num = $1`
+	rows, err := tx.Query(ctx, query, orderNum)
 	if err != nil {
-		s.logger.Sugar().Errorf(err.Error())
-		return OrdersInfo{}, err
+		return OrderInfo{}, err
+	}
+	orders, err := s.getOrdersFromRequest(rows, query)
+	rows.Close()
+	if err != nil {
+		return OrderInfo{}, err
+	}
+	if len(orders.Orders) == 0 {
+		return OrderInfo{}, ErrOrderNotFound
 	}
-	return s.getOrdersFromRequest(rows, query)
+	return orders.Orders[0], nil
 }
 
 func (s *Storage) getOrdersFromRequest(rows pgx.Rows, query string) (OrdersInfo, error) {
 	orders := make([]OrderInfo, 0)
 	var (
-		oUser       string
-		oNumber     string
-		oStatus     OrderStatus
-		oAccrual    pgtype.Int8
-		oUploadedAt time.Time
+		oID          string
+		oUser        string
+		oNumber      string
+		oStatus      OrderStatus
+		oAccrual     pgtype.Int8
+		oBonus       int64
+		oUploadedAt  time.Time
+		oProcessedAt pgtype.Timestamptz
 	)
 
 	for rows.Next() {
-		err := rows.Scan(&oNumber, &oStatus, &oAccrual, &oUploadedAt)
+		err := rows.Scan(&oID, &oNumber, &oStatus, &oAccrual, &oBonus, &oUploadedAt, &oProcessedAt)
 		if err != nil {
 			s.logger.Sugar().Errorf("Query: %s, %s", query, err.Error())
 			return OrdersInfo{}, err
 		}
 		accr := Numeric(oAccrual.Int64)
-		orders = append(orders, OrderInfo{User: oUser, Number: oNumber, Status: oStatus, Accrual: &accr, UploadedAt: RFC3339Time(oUploadedAt)})
+		order := OrderInfo{id: oID, User: oUser, Number: oNumber, Status: oStatus, Accrual: &accr, UploadedAt: RFC3339Time(oUploadedAt)}
+		if oBonus > 0 {
+			bonus := Numeric(oBonus)
+			order.Bonus = &bonus
+		}
+		if oProcessedAt.Valid {
+			processedAt := RFC3339Time(oProcessedAt.Time)
+			order.ProcessedAt = &processedAt
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return OrdersInfo{}, err
 	}
 
 	return OrdersInfo{Orders: orders}, nil
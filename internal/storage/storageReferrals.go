@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"strings"
+	"time"
+)
+
+const referralCodeAttempts = 5 // Attempts to generate unique referral code
+
+func generateReferralCode() (string, error) {
+	buf := make([]byte, 5) // 8 characters of base32
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(buf), nil
+}
+
+// addReferralTx links new user to referrer by referral code. Must be called within registration transaction.
+func (s *Storage) addReferralTx(ctx context.Context, tx pgx.Tx, refereeID string, referralCode string) error {
+	// Referrer is locked to check the limit of referrals
+	var referrerID string
+	query := `SELECT id FROM users WHERE referral_code = $1 FOR UPDATE`
+	err := tx.QueryRow(ctx, query, strings.ToUpper(strings.TrimSpace(referralCode))).Scan(&referrerID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrReferralCodeNotFound
+		}
+		return err
+	}
+
+	if limit := s.config.ReferralMaxPerUser; limit > 0 {
+		var referred int
+		query = `SELECT COUNT(*) FROM referrals WHERE referrer_id = $1`
+		if err = tx.QueryRow(ctx, query, referrerID).Scan(&referred); err != nil {
+			return err
+		}
+		if referred >= limit {
+			return ErrReferralLimitExceeded
+		}
+	}
+
+	query = `INSERT INTO referrals (referee_id, referrer_id) VALUES ($1, $2)`
+	if _, err = tx.Exec(ctx, query, refereeID, referrerID); err != nil {
+		return err
+	}
+	s.logger.Sugar().Infof("User %s is referred by %s", refereeID, referrerID)
+	return nil
+}
+
+// applyReferralTx rewards referee and referrer for first processed order of referee. Must be called within transaction
+// after order is marked as processed. Returns bonus of referee.
+func (s *Storage) applyReferralTx(ctx context.Context, tx pgx.Tx, refereeID string, orderNum string) (Numeric, error) {
+	referrerBonus, refereeBonus := Numeric(s.config.ReferrerBonus), Numeric(s.config.RefereeBonus)
+
+	var referrerID string
+	query := `UPDATE referrals SET rewarded_at = NOW(), order_num = $2, referrer_bonus = $3, referee_bonus = $4
+		WHERE referee_id = $1 AND rewarded_at IS NULL RETURNING referrer_id`
+	err := tx.QueryRow(ctx, query, refereeID, orderNum, referrerBonus, refereeBonus).Scan(&referrerID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if refereeBonus > 0 {
+		err = s.postLedger(ctx, tx, ledgerEntry{
+			UserID:         refereeID,
+			Kind:           LedgerReferral,
+			Amount:         refereeBonus,
+			CounterAccount: AccountReferrals,
+			OrderNum:       orderNum,
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	// Order number of referee is not shown to referrer
+	if referrerBonus > 0 {
+		err = s.postLedger(ctx, tx, ledgerEntry{
+			UserID:         referrerID,
+			Kind:           LedgerReferral,
+			Amount:         referrerBonus,
+			CounterAccount: AccountReferrals,
+		})
+		if err != nil {
+			return 0, err
+		}
+		if err = s.repayDebtTx(ctx, tx, referrerID, "", referrerBonus); err != nil {
+			return 0, err
+		}
+		if err = s.addBalanceEventTx(ctx, tx, referrerID); err != nil {
+			return 0, err
+		}
+	}
+
+	s.logger.Sugar().Infof("Referral bonuses for order %s: referee %s - %s, referrer %s - %s",
+		orderNum, refereeID, &refereeBonus, referrerID, &referrerBonus)
+	return refereeBonus, nil
+}
+
+// GetReferral returns referral code of user (generates it on first call) and statistics of referred users
+func (s *Storage) GetReferral(ctx context.Context, userID string) (ReferralInfo, error) {
+	for attempt := 0; ; attempt++ {
+		code, err := generateReferralCode()
+		if err != nil {
+			return ReferralInfo{}, err
+		}
+		query := `UPDATE users SET referral_code = $2 WHERE id = $1 AND referral_code IS NULL`
+		_, err = s.dbConn.Exec(ctx, query, userID, code)
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), pgerrcode.UniqueViolation) || attempt+1 >= referralCodeAttempts {
+			return ReferralInfo{}, err
+		}
+	}
+
+	var res ReferralInfo
+	query := `SELECT u.referral_code, COUNT(r.referee_id), COUNT(r.rewarded_at)
+		FROM users u LEFT JOIN referrals r ON r.referrer_id = u.id
+		WHERE u.id = $1 GROUP BY u.id`
+	if err := s.dbConn.QueryRow(ctx, query, userID).Scan(&res.Code, &res.Invited, &res.Rewarded); err != nil {
+		return ReferralInfo{}, err
+	}
+	res.Limit = s.config.ReferralMaxPerUser
+	return res, nil
+}
+
+// GetReferralsReport returns all referrals: who referred whom and which bonuses were granted
+func (s *Storage) GetReferralsReport(ctx context.Context) ([]ReferralReportInfo, error) {
+	query := `SELECT rr.login, re.login, r.created_at, r.rewarded_at, r.order_num, r.referrer_bonus, r.referee_bonus
+		FROM referrals r
+		JOIN users rr ON rr.id = r.referrer_id
+		JOIN users re ON re.id = r.referee_id
+		ORDER BY r.created_at, r.referee_id`
+	rows, err := s.dbConn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]ReferralReportInfo, 0)
+	for rows.Next() {
+		var (
+			r             ReferralReportInfo
+			createdAt     time.Time
+			rewardedAt    pgtype.Timestamptz
+			orderNum      pgtype.Text
+			referrerBonus Numeric
+			refereeBonus  Numeric
+		)
+		if err = rows.Scan(&r.Referrer, &r.Referee, &createdAt, &rewardedAt, &orderNum, &referrerBonus, &refereeBonus); err != nil {
+			return nil, err
+		}
+		r.CreatedAt = RFC3339Time(createdAt)
+		if rewardedAt.Valid {
+			rewarded := RFC3339Time(rewardedAt.Time)
+			r.RewardedAt = &rewarded
+			r.Order = orderNum.String
+			r.ReferrerBonus = &referrerBonus
+			r.RefereeBonus = &refereeBonus
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5"
+	"time"
+)
+
+// Withdrawal statuses
+const (
+	WithdrawalCompleted         = "COMPLETED"
+	WithdrawalPartiallyReversed = "PARTIALLY_REVERSED"
+	WithdrawalReversed          = "REVERSED"
+)
+
+func withdrawalStatus(sum, reversed Numeric) string {
+	switch {
+	case reversed == 0:
+		return WithdrawalCompleted
+	case reversed < sum:
+		return WithdrawalPartiallyReversed
+	default:
+		return WithdrawalReversed
+	}
+}
+
+// ReverseWithdrawal refunds withdrawal of order fully (sum is nil) or partially. actor is recorded as author of reversal.
+func (s *Storage) ReverseWithdrawal(ctx context.Context, orderNum string, sum *Numeric, reason string, actor string) (WithdrawalReversalInfo, error) {
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var (
+		withdrawalID string
+		userID       string
+		wSum         Numeric
+		wReversed    Numeric
+	)
+	query := `SELECT id, user_id, sum, reversed FROM withdrawals WHERE order_num = $1 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, orderNum).Scan(&withdrawalID, &userID, &wSum, &wReversed)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return WithdrawalReversalInfo{}, ErrWithdrawalNotFound
+		}
+		return WithdrawalReversalInfo{}, err
+	}
+
+	amount := wSum - wReversed
+	if sum != nil {
+		amount = *sum
+	}
+	if amount <= 0 || amount > wSum-wReversed {
+		return WithdrawalReversalInfo{}, ErrReversalExceedsWithdrawal
+	}
+
+	var createdAt time.Time
+	query = `INSERT INTO withdrawal_reversals (withdrawal_id, sum, reason, created_by) VALUES ($1, $2, $3, $4) RETURNING created_at`
+	if err = tx.QueryRow(ctx, query, withdrawalID, amount, reason, actor).Scan(&createdAt); err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+
+	query = `UPDATE withdrawals SET reversed = reversed + $2 WHERE id = $1`
+	if _, err = tx.Exec(ctx, query, withdrawalID, amount); err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+
+	restored, err := s.restoreLotsTx(ctx, tx, withdrawalID, amount)
+	if err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+	err = s.postLedger(ctx, tx, ledgerEntry{
+		UserID:         userID,
+		Kind:           LedgerReversal,
+		Amount:         amount,
+		CounterAccount: AccountWithdrawals,
+		OrderNum:       orderNum,
+		WithdrawalID:   withdrawalID,
+		Lots:           restored,
+	})
+	if err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return WithdrawalReversalInfo{}, err
+	}
+	txOk = true
+
+	reversed := wReversed + amount
+	s.logger.Sugar().Infof("Withdrawal for order %s reversed by %s: %s points, reason: %s", orderNum, actor, &amount, reason)
+	return WithdrawalReversalInfo{
+		Order:     orderNum,
+		Sum:       &amount,
+		Reversed:  &reversed,
+		Status:    withdrawalStatus(wSum, reversed),
+		CreatedAt: RFC3339Time(createdAt),
+	}, nil
+}
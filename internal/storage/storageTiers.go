@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"github.com/jackc/pgx/v5"
+	"math"
+	"yapracticum-go-diploma-1/internal/config"
+)
+
+// Tier is computed by accruals of last 12 months. Bonus points are not counted. Clawback of order is taken
+// from its accrual first, so refunded orders do not count towards tier.
+const queryRollingAccrual = `SELECT COALESCE((
+		SELECT SUM(l.amount - LEAST(COALESCE(o.clawed_back, 0), l.amount))
+		FROM ledger_entries l LEFT JOIN orders o ON o.order_num = l.order_num
+		WHERE l.user_id = u.id AND l.kind = 'accrual' AND l.created_at > NOW() - interval '12 months'
+	), 0)::bigint FROM users u WHERE u.id = $1`
+
+// tierFor returns index of the highest tier reached by accrued points (-1 - none)
+func tierFor(tiers []config.Tier, accrued Numeric) int {
+	res := -1
+	for i, t := range tiers {
+		if int64(accrued) >= t.Threshold {
+			res = i
+		}
+	}
+	return res
+}
+
+func tierBonus(tier config.Tier, accrual Numeric) Numeric {
+	return Numeric(math.Round(float64(accrual) * (tier.Multiplier - 1)))
+}
+
+// applyTierTx computes bonus of accrual by tier of user and stores it in order. Must be called within transaction
+// before accrual is posted, so the order itself does not count towards tier.
+func (s *Storage) applyTierTx(ctx context.Context, tx pgx.Tx, userID string, orderNum string, accrual Numeric) (Numeric, error) {
+	tiers := s.config.Tiers
+	if len(tiers) == 0 || accrual <= 0 {
+		return 0, nil
+	}
+
+	// User row is locked, so concurrent accruals of user see each other
+	var accrued Numeric
+	if err := tx.QueryRow(ctx, queryRollingAccrual+" FOR UPDATE", userID).Scan(&accrued); err != nil {
+		return 0, err
+	}
+	idx := tierFor(tiers, accrued)
+	if idx < 0 {
+		return 0, nil
+	}
+
+	bonus := tierBonus(tiers[idx], accrual)
+	query := `UPDATE orders SET bonus = $2, tier = $3 WHERE order_num = $1`
+	if _, err := tx.Exec(ctx, query, orderNum, bonus, tiers[idx].Name); err != nil {
+		return 0, err
+	}
+	if bonus > 0 {
+		s.logger.Sugar().Infof("Tier %s bonus for order %s: %s points", tiers[idx].Name, orderNum, &bonus)
+	}
+	return bonus, nil
+}
+
+// GetTier returns current tier of user and progress to the next one
+func (s *Storage) GetTier(ctx context.Context, userID string) (TierInfo, error) {
+	tiers := s.config.Tiers
+	if len(tiers) == 0 {
+		return TierInfo{}, ErrTiersDisabled
+	}
+
+	var accrued Numeric
+	if err := s.dbConn.QueryRow(ctx, queryRollingAccrual, userID).Scan(&accrued); err != nil {
+		return TierInfo{}, err
+	}
+
+	res := TierInfo{Multiplier: 1, Accrued: &accrued}
+	idx := tierFor(tiers, accrued)
+	var from Numeric
+	if idx >= 0 {
+		res.Tier = tiers[idx].Name
+		res.Multiplier = tiers[idx].Multiplier
+		from = Numeric(tiers[idx].Threshold)
+	}
+	if idx+1 < len(tiers) {
+		next := tiers[idx+1]
+		threshold := Numeric(next.Threshold)
+		remaining := threshold - accrued
+		res.Next = &NextTierInfo{
+			Tier:      next.Name,
+			Threshold: &threshold,
+			Remaining: &remaining,
+			Progress:  math.Round(float64(accrued-from)/float64(threshold-from)*100) / 100,
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"strings"
+	"time"
+)
+
+// Transfer directions
+const (
+	TransferOut = "out"
+	TransferIn  = "in"
+)
+
+// userAccount: counter account of ledger entry, which moves points between users
+func userAccount(userID string) string {
+	return "user:" + userID
+}
+
+// Transfer moves points of sender to user with recipientLogin within one transaction
+func (s *Storage) Transfer(ctx context.Context, senderID string, recipientLogin string, sum Numeric) (TransferInfo, error) {
+	s.logger.Sugar().Infof("Transfer attempt: %s points to %s", &sum, recipientLogin)
+
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return TransferInfo{}, err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var recipientID string
+	query := `SELECT id FROM users WHERE login = $1`
+	if err = tx.QueryRow(ctx, query, recipientLogin).Scan(&recipientID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TransferInfo{}, ErrTransferRecipientNotFound
+		}
+		return TransferInfo{}, err
+	}
+	if recipientID == senderID {
+		return TransferInfo{}, ErrTransferToSelf
+	}
+
+	// Both users are locked in the same order by all transfers, so opposite transfers do not deadlock
+	query = `SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE`
+	rows, err := tx.Query(ctx, query, senderID, recipientID)
+	if err != nil {
+		return TransferInfo{}, err
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return TransferInfo{}, err
+	}
+
+	if limit := Numeric(s.config.TransferDailyLimit); limit > 0 {
+		var transferred Numeric
+		query = `SELECT COALESCE(SUM(sum), 0)::bigint FROM transfers WHERE sender_id = $1 AND created_at > NOW() - interval '1 day'`
+		if err = tx.QueryRow(ctx, query, senderID).Scan(&transferred); err != nil {
+			return TransferInfo{}, err
+		}
+		if transferred+sum > limit {
+			return TransferInfo{}, ErrTransferLimitExceeded
+		}
+	}
+
+	var (
+		transferID string
+		createdAt  time.Time
+	)
+	query = `INSERT INTO transfers (sender_id, recipient_id, sum) VALUES ($1, $2, $3) RETURNING id, created_at`
+	if err = tx.QueryRow(ctx, query, senderID, recipientID, sum).Scan(&transferID, &createdAt); err != nil {
+		return TransferInfo{}, err
+	}
+
+	consumed, err := s.postLedgerLots(ctx, tx, ledgerEntry{
+		UserID:         senderID,
+		Kind:           LedgerTransferOut,
+		Amount:         -sum,
+		CounterAccount: userAccount(recipientID),
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), pgerrcode.CheckViolation) {
+			return TransferInfo{}, ErrWithdrawNotEnough
+		}
+		return TransferInfo{}, err
+	}
+	err = s.postLedger(ctx, tx, ledgerEntry{
+		UserID:         recipientID,
+		Kind:           LedgerTransferIn,
+		Amount:         sum,
+		CounterAccount: userAccount(senderID),
+		Lots:           consumed,
+	})
+	if err != nil {
+		return TransferInfo{}, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return TransferInfo{}, err
+	}
+	txOk = true
+
+	s.logger.Sugar().Infof("Transfer %s: %s points from %s to %s", transferID, &sum, senderID, recipientID)
+	return TransferInfo{
+		ID:           transferID,
+		Direction:    TransferOut,
+		Counterparty: recipientLogin,
+		Sum:          &sum,
+		CreatedAt:    RFC3339Time(createdAt),
+	}, nil
+}
+
+// GetTransfers returns transfers sent and received by user
+func (s *Storage) GetTransfers(ctx context.Context, userID string) ([]TransferInfo, error) {
+	query := `SELECT t.id, CASE WHEN t.sender_id = $1 THEN $2 ELSE $3 END, u.login, t.sum, t.created_at
+		FROM transfers t
+		JOIN users u ON u.id = CASE WHEN t.sender_id = $1 THEN t.recipient_id ELSE t.sender_id END
+		WHERE t.sender_id = $1 OR t.recipient_id = $1
+		ORDER BY t.created_at, t.id`
+	rows, err := s.dbConn.Query(ctx, query, userID, TransferOut, TransferIn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]TransferInfo, 0)
+	for rows.Next() {
+		var (
+			t         TransferInfo
+			sum       Numeric
+			createdAt time.Time
+		)
+		if err = rows.Scan(&t.ID, &t.Direction, &t.Counterparty, &sum, &createdAt); err != nil {
+			return nil, err
+		}
+		t.Sum = &sum
+		t.CreatedAt = RFC3339Time(createdAt)
+		res = append(res, t)
+	}
+	return res, rows.Err()
+}
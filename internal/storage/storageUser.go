@@ -4,15 +4,23 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/scrypt"
 	"io"
 	"strings"
+	"time"
 	"yapracticum-go-diploma-1/internal/utils"
 )
 
 func (s *Storage) UserRegister(ctx context.Context, login string, password string) error {
+	return s.UserRegisterReferred(ctx, login, password, "")
+}
+
+// UserRegisterReferred registers user, referred by owner of referralCode (empty - not referred)
+func (s *Storage) UserRegisterReferred(ctx context.Context, login string, password string, referralCode string) error {
 
 	salt := make([]byte, 32) // salt, 32 bytes len
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
@@ -23,30 +31,74 @@ func (s *Storage) UserRegister(ctx context.Context, login string, password strin
 		return err
 	}
 
-	query := `INSERT INTO users (login, password, salt) VALUES ($1, $2, $3)`
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	var userID string
+	query := `INSERT INTO users (login, password, salt) VALUES ($1, $2, $3) RETURNING id`
 
-	if _, err = s.dbConn.Exec(ctx, query, login, hex.EncodeToString(hash), hex.EncodeToString(salt)); err != nil {
+	if err = tx.QueryRow(ctx, query, login, hex.EncodeToString(hash), hex.EncodeToString(salt)).Scan(&userID); err != nil {
 		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
 			s.logger.Sugar().Errorf("Login %s already exists in database", login)
 			return fmt.Errorf("%s: %w", err.Error(), ErrUserAlreadyExists)
 		}
+		if isDataException(err) {
+			return fmt.Errorf("%s: %w", err.Error(), ErrUserDataInvalid)
+		}
 		return err
 	}
 
+	if referralCode != "" {
+		if err = s.addReferralTx(ctx, tx, userID, referralCode); err != nil {
+			if isDataException(err) {
+				return fmt.Errorf("%s: %w", err.Error(), ErrUserDataInvalid)
+			}
+			return err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	txOk = true
+
 	return nil
 }
 
-func (s *Storage) UserCheckLoggedIn(token string) (string, error) {
+func (s *Storage) UserCheckLoggedIn(ctx context.Context, token string) (UserSession, error) {
 	ac := utils.AuthClaims{}
-	err := ac.SetFromJWT(token, s.encKey)
-	if err != nil {
-		return "", ErrUserNotLoggedIn
+	err := ac.SetFromJWT(token, s.keys)
+	if err != nil || ac.SessionID == "" {
+		return UserSession{}, ErrUserNotLoggedIn
 	}
 
-	return ac.UserID, nil
+	revoked, ok := s.sessions.get(ac.SessionID)
+	if !ok {
+		query := `SELECT revoked_at IS NOT NULL OR expires_at < current_timestamp FROM sessions WHERE id = $1`
+		if err = s.dbConn.QueryRow(ctx, query, ac.SessionID).Scan(&revoked); err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return UserSession{}, err
+			}
+			revoked = true
+		}
+		s.sessions.set(ac.SessionID, revoked)
+	}
+	if revoked {
+		return UserSession{}, fmt.Errorf("session %s revoked: %w", ac.SessionID, ErrUserNotLoggedIn)
+	}
+
+	return UserSession{UserID: ac.UserID, SessionID: ac.SessionID}, nil
 }
 
-func (s *Storage) UserLogin(ctx context.Context, login string, password string) (string, error) {
+func (s *Storage) UserLogin(ctx context.Context, login string, password string) (AuthTokens, error) {
 
 	var err error
 	query := `SELECT id, login, password, salt FROM users WHERE login=$1`
@@ -58,25 +110,115 @@ func (s *Storage) UserLogin(ctx context.Context, login string, password string)
 		sSalt   string
 	)
 	if err = row.Scan(&sUserID, &sLogin, &sPassw, &sSalt); err != nil {
-		return "", err
+		// Unknown login is reported as wrong password
+		if errors.Is(err, pgx.ErrNoRows) {
+			return AuthTokens{}, ErrUserAuthFailed
+		}
+		if isDataException(err) {
+			return AuthTokens{}, fmt.Errorf("%s: %w", err.Error(), ErrUserDataInvalid)
+		}
+		return AuthTokens{}, err
 	}
 
 	xSalt, _ := hex.DecodeString(sSalt)
 
 	var key []byte
 	if key, err = scrypt.Key([]byte(password), xSalt, 1<<14, 8, 1, 256); err != nil {
-		return "", err
+		return AuthTokens{}, err
 	}
 
 	if hex.EncodeToString(key) != sPassw {
-		return "", ErrUserAuthFailed
+		return AuthTokens{}, ErrUserAuthFailed
+	}
+
+	return s.newSession(ctx, sUserID)
+}
+
+// newSession creates database session with refresh token and issues access token bound to it
+func (s *Storage) newSession(ctx context.Context, userID string) (AuthTokens, error) {
+	refresh, refreshHash, err := utils.NewRefreshToken()
+	if err != nil {
+		return AuthTokens{}, err
+	}
+
+	var sessionID string
+	query := `INSERT INTO sessions (user_id, refresh_hash, expires_at) VALUES ($1, $2, $3) RETURNING id`
+	err = s.dbConn.QueryRow(ctx, query, userID, refreshHash, time.Now().Add(utils.RefreshTokenExp)).Scan(&sessionID)
+	if err != nil {
+		return AuthTokens{}, err
 	}
 
-	ac := utils.AuthClaims{UserID: sUserID}
-	jwt, err := ac.GetJWT(s.encKey)
+	ac := utils.AuthClaims{UserID: userID, SessionID: sessionID}
+	access, err := ac.GetJWT(s.keys)
 	if err != nil {
-		return "", err
+		return AuthTokens{}, err
 	}
 
-	return jwt, nil
+	return AuthTokens{Access: access, Refresh: refresh}, nil
+}
+
+// UserRefresh rotates refresh token of active session and issues new access token
+func (s *Storage) UserRefresh(ctx context.Context, refreshToken string) (AuthTokens, error) {
+	refresh, refreshHash, err := utils.NewRefreshToken()
+	if err != nil {
+		return AuthTokens{}, err
+	}
+
+	var (
+		sessionID string
+		userID    string
+	)
+	query := `UPDATE sessions SET refresh_hash = $2, refreshed_at = current_timestamp, expires_at = $3
+		WHERE refresh_hash = $1 AND revoked_at IS NULL AND expires_at > current_timestamp
+		RETURNING id, user_id`
+	err = s.dbConn.QueryRow(ctx, query, utils.HashRefreshToken(refreshToken), refreshHash, time.Now().Add(utils.RefreshTokenExp)).
+		Scan(&sessionID, &userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return AuthTokens{}, ErrSessionNotFound
+		}
+		return AuthTokens{}, err
+	}
+
+	ac := utils.AuthClaims{UserID: userID, SessionID: sessionID}
+	access, err := ac.GetJWT(s.keys)
+	if err != nil {
+		return AuthTokens{}, err
+	}
+
+	return AuthTokens{Access: access, Refresh: refresh}, nil
+}
+
+func (s *Storage) UserLogout(ctx context.Context, sessionID string) error {
+	// Other replicas drop revoked session from their cache on notification
+	query := `WITH r AS (UPDATE sessions SET revoked_at = current_timestamp WHERE id = $1 AND revoked_at IS NULL RETURNING id)
+		SELECT pg_notify($2, id::text) FROM r`
+	tag, err := s.dbConn.Exec(ctx, query, sessionID, sessionsChannel)
+	if err != nil {
+		return err
+	}
+	s.sessions.set(sessionID, true)
+	if tag.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *Storage) UserLogoutAll(ctx context.Context, userID string) error {
+	query := `WITH r AS (UPDATE sessions SET revoked_at = current_timestamp WHERE user_id = $1 AND revoked_at IS NULL RETURNING id)
+		SELECT id::text, pg_notify($2, id::text) FROM r`
+	rows, err := s.dbConn.Query(ctx, query, userID, sessionsChannel)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sessionID string
+	for rows.Next() {
+		if err = rows.Scan(&sessionID, nil); err != nil {
+			return err
+		}
+		s.sessions.set(sessionID, true)
+	}
+	return rows.Err()
 }
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	webhookDispatchBatch = 1000 // Events fanned out to deliveries by one query
+	webhookDeliveriesLog = 100  // Last deliveries shown in log
+)
+
+// webhookError converts errors of queries by webhook id
+func webhookError(err error) error {
+	if errors.Is(err, pgx.ErrNoRows) || strings.Contains(err.Error(), pgerrcode.InvalidTextRepresentation) {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+// CreateWebhook registers endpoint. Secret is generated, if not set.
+func (s *Storage) CreateWebhook(ctx context.Context, webhook WebhookInfo) (WebhookInfo, error) {
+	u, err := url.Parse(webhook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return WebhookInfo{}, fmt.Errorf("url must be absolute http(s) URL: %w", ErrWebhookInvalid)
+	}
+	if webhook.EventTypes == nil {
+		webhook.EventTypes = []string{}
+	}
+	for _, t := range webhook.EventTypes {
+		if !slices.Contains(WebhookEventTypes, t) {
+			return WebhookInfo{}, fmt.Errorf("unknown event type %q: %w", t, ErrWebhookInvalid)
+		}
+	}
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return WebhookInfo{}, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+
+	var createdAt time.Time
+	query := `INSERT INTO webhooks (url, secret, event_types) VALUES ($1, $2, $3) RETURNING id, created_at`
+	err = s.dbConn.QueryRow(ctx, query, webhook.URL, webhook.Secret, webhook.EventTypes).Scan(&webhook.ID, &createdAt)
+	if err != nil {
+		return WebhookInfo{}, err
+	}
+	webhook.CreatedAt = RFC3339Time(createdAt)
+	s.logger.Sugar().Infof("Webhook %s (%s) created", webhook.ID, webhook.URL)
+	return webhook, nil
+}
+
+// DeleteWebhook stops deliveries to endpoint. Webhook is kept in database along with its delivery log.
+func (s *Storage) DeleteWebhook(ctx context.Context, webhookID string) error {
+	txOk := false
+	tx, err := s.dbConn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.ReadCommitted})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if !txOk {
+			tx.Rollback(ctx)
+		}
+	}()
+
+	query := `UPDATE webhooks SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL`
+	tag, err := tx.Exec(ctx, query, webhookID)
+	if err != nil {
+		return webhookError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	query = `UPDATE webhook_deliveries SET status = $2, finished_at = NOW() WHERE webhook_id = $1 AND status = $3`
+	if _, err = tx.Exec(ctx, query, webhookID, DeliveryCancelled, DeliveryPending); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return err
+	}
+	txOk = true
+	s.logger.Sugar().Infof("Webhook %s deleted", webhookID)
+	return nil
+}
+
+// GetWebhooks returns active webhooks without secrets
+func (s *Storage) GetWebhooks(ctx context.Context) ([]WebhookInfo, error) {
+	query := `SELECT id, url, event_types, created_at FROM webhooks WHERE deleted_at IS NULL ORDER BY created_at, id`
+	rows, err := s.dbConn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookInfo, 0)
+	for rows.Next() {
+		var (
+			w         WebhookInfo
+			createdAt time.Time
+		)
+		if err = rows.Scan(&w.ID, &w.URL, &w.EventTypes, &createdAt); err != nil {
+			return nil, err
+		}
+		w.CreatedAt = RFC3339Time(createdAt)
+		res = append(res, w)
+	}
+	return res, rows.Err()
+}
+
+// GetWebhookDeliveries returns last deliveries of webhook, newest first
+func (s *Storage) GetWebhookDeliveries(ctx context.Context, webhookID string) ([]WebhookDeliveryInfo, error) {
+	var exists bool
+	query := `SELECT true FROM webhooks WHERE id = $1`
+	if err := s.dbConn.QueryRow(ctx, query, webhookID).Scan(&exists); err != nil {
+		return nil, webhookError(err)
+	}
+
+	query = `SELECT d.id, d.event_id, e.type, d.status, d.attempts, d.last_status_code, d.last_error,
+			d.created_at, d.next_attempt_at, d.finished_at
+		FROM webhook_deliveries d
+		JOIN webhook_events e ON e.id = d.event_id
+		WHERE d.webhook_id = $1
+		ORDER BY d.id DESC
+		LIMIT $2`
+	rows, err := s.dbConn.Query(ctx, query, webhookID, webhookDeliveriesLog)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookDeliveryInfo, 0)
+	for rows.Next() {
+		var (
+			d             WebhookDeliveryInfo
+			statusCode    pgtype.Int4
+			lastError     pgtype.Text
+			createdAt     time.Time
+			nextAttemptAt time.Time
+			finishedAt    pgtype.Timestamptz
+		)
+		err = rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &statusCode, &lastError,
+			&createdAt, &nextAttemptAt, &finishedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.LastStatusCode = int(statusCode.Int32)
+		d.LastError = lastError.String
+		d.CreatedAt = RFC3339Time(createdAt)
+		if d.Status == DeliveryPending {
+			next := RFC3339Time(nextAttemptAt)
+			d.NextAttemptAt = &next
+		}
+		if finishedAt.Valid {
+			finished := RFC3339Time(finishedAt.Time)
+			d.FinishedAt = &finished
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// addWebhookEventTx writes event to outbox. It is delivered only if transaction is committed.
+func (s *Storage) addWebhookEventTx(ctx context.Context, tx pgx.Tx, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO webhook_events (type, data) VALUES ($1, $2)`
+	_, err = tx.Exec(ctx, query, eventType, string(payload))
+	return err
+}
+
+// userWebhookInfoTx returns login and available points of user
+func userWebhookInfoTx(ctx context.Context, tx pgx.Tx, userID string) (string, Numeric, error) {
+	var (
+		login   string
+		balance Numeric
+	)
+	query := `SELECT login, balance - held FROM users WHERE id = $1`
+	err := tx.QueryRow(ctx, query, userID).Scan(&login, &balance)
+	return login, balance, err
+}
+
+// addOrderWebhookEventTx writes event of finalized order. credited is accrual with all bonuses.
+func (s *Storage) addOrderWebhookEventTx(ctx context.Context, tx pgx.Tx, eventType string, userID string, orderNum string, credited Numeric) error {
+	order, err := s.getOrderTx(ctx, tx, orderNum)
+	if err != nil {
+		return err
+	}
+	login, balance, err := userWebhookInfoTx(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	event := WebhookOrderEvent{UserID: userID, Login: login, Order: order, Balance: &balance}
+	if eventType == WebhookOrderProcessed {
+		event.Credited = &credited
+	}
+	return s.addWebhookEventTx(ctx, tx, eventType, event)
+}
+
+// addWithdrawalWebhookEventTx writes event of new withdrawal
+func (s *Storage) addWithdrawalWebhookEventTx(ctx context.Context, tx pgx.Tx, userID string, withdrawalID string) error {
+	var (
+		withdrawal  WithdrawalInfo
+		sum         Numeric
+		processedAt time.Time
+	)
+	query := `SELECT order_num, sum, processed_at FROM withdrawals WHERE id = $1`
+	if err := tx.QueryRow(ctx, query, withdrawalID).Scan(&withdrawal.Order, &sum, &processedAt); err != nil {
+		return err
+	}
+	withdrawal.Sum = &sum
+	withdrawal.ProcessedAt = RFC3339Time(processedAt)
+	withdrawal.Status = withdrawalStatus(sum, 0)
+
+	login, balance, err := userWebhookInfoTx(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	return s.addWebhookEventTx(ctx, tx, WebhookWithdrawalCreated,
+		WebhookWithdrawalEvent{UserID: userID, Login: login, Withdrawal: withdrawal, Balance: &balance})
+}
+
+// DispatchWebhookEvents creates deliveries of new outbox events to webhooks subscribed to them.
+// Returns number of dispatched events.
+func (s *Storage) DispatchWebhookEvents(ctx context.Context) (int, error) {
+	query := `WITH ev AS (
+			SELECT id, type FROM webhook_events WHERE dispatched_at IS NULL ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED),
+		ins AS (
+			INSERT INTO webhook_deliveries (webhook_id, event_id)
+			SELECT w.id, ev.id FROM ev
+			JOIN webhooks w ON w.deleted_at IS NULL AND (cardinality(w.event_types) = 0 OR ev.type = ANY(w.event_types))
+			ON CONFLICT DO NOTHING)
+		UPDATE webhook_events SET dispatched_at = NOW() WHERE id IN (SELECT id FROM ev)`
+	tag, err := s.dbConn.Exec(ctx, query, webhookDispatchBatch)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// ClaimWebhookDeliveries locks up to limit due deliveries during lease. Deliveries locked by other workers are skipped.
+func (s *Storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	query := `UPDATE webhook_deliveries d
+		SET locked_until = current_timestamp + $3 * interval '1 millisecond', attempts = d.attempts + 1
+		FROM webhooks w, webhook_events e
+		WHERE d.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt_at <= current_timestamp
+				AND (locked_until IS NULL OR locked_until < current_timestamp)
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+			AND w.id = d.webhook_id AND e.id = d.event_id
+		RETURNING d.id, w.id, w.url, w.secret, e.id, e.type, e.data, e.created_at, d.attempts`
+	rows, err := s.dbConn.Query(ctx, query, limit, DeliveryPending, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookDelivery, 0, limit)
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.URL, &d.Secret, &d.EventID, &d.EventType, &d.Data, &d.CreatedAt, &d.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// FinishWebhookAttempt records result of delivery attempt and releases delivery lock
+func (s *Storage) FinishWebhookAttempt(ctx context.Context, deliveryID int64, attempt WebhookAttempt) error {
+	status := DeliveryPending
+	switch {
+	case attempt.Delivered:
+		status = DeliveryDelivered
+	case attempt.NextAttemptAt.IsZero():
+		status = DeliveryFailed
+	}
+	nextAttemptAt := pgtype.Timestamptz{Time: attempt.NextAttemptAt, Valid: status == DeliveryPending}
+
+	query := `UPDATE webhook_deliveries SET status = $2, last_status_code = NULLIF($3, 0), last_error = NULLIF($4, ''),
+			next_attempt_at = COALESCE($5, next_attempt_at), locked_until = NULL,
+			finished_at = CASE WHEN $2 = $6 THEN NULL ELSE NOW() END
+		WHERE id = $1 AND status = $6`
+	_, err := s.dbConn.Exec(ctx, query, deliveryID, status, attempt.StatusCode, attempt.Error, nextAttemptAt, DeliveryPending)
+	return err
+}
+
+// PurgeWebhookEvents deletes dispatched events older than ttl along with their finished deliveries
+func (s *Storage) PurgeWebhookEvents(ctx context.Context, ttl time.Duration) (int, error) {
+	query := `DELETE FROM webhook_events e
+		WHERE e.created_at < $1 AND e.dispatched_at IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.event_id = e.id AND d.status = $2)`
+	tag, err := s.dbConn.Exec(ctx, query, time.Now().Add(-ttl), DeliveryPending)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
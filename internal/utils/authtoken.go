@@ -2,45 +2,82 @@ package utils
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"time"
 )
 
 const TokenExp = time.Hour * 3
+const RefreshTokenExp = time.Hour * 24 * 30
 
 type AuthClaims struct {
 	jwt.RegisteredClaims
-	UserID  string `json:"user_id"`
-	RandNum []byte `json:"rand_num"`
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+	RandNum   []byte `json:"rand_num"`
 }
 
-func (ac *AuthClaims) GetJWT(key string) (string, error) {
+// NewRefreshToken returns opaque refresh token and its hash to be stored in database
+func NewRefreshToken() (string, string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", "", err
+	}
+	tokenString := hex.EncodeToString(token)
+	return tokenString, HashRefreshToken(tokenString), nil
+}
+
+func HashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (ac *AuthClaims) GetJWT(keys *KeyRing) (string, error) {
+	key, err := keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
 	secRandNum := make([]byte, 8)
-	_, err := rand.Read(secRandNum)
+	_, err = rand.Read(secRandNum)
 	if err != nil {
 		return "", err
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &AuthClaims{
-		UserID:  ac.UserID,
-		RandNum: secRandNum,
+		UserID:    ac.UserID,
+		SessionID: ac.SessionID,
+		RandNum:   secRandNum,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenExp)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	})
-	tokenString, err := token.SignedString([]byte(key))
+	token.Header["kid"] = key.ID
+	tokenString, err := token.SignedString([]byte(key.Secret))
 	if err != nil {
 		return "", err
 	}
 	return tokenString, nil
 }
 
-func (ac *AuthClaims) SetFromJWT(tokenString string, key string) error {
+func (ac *AuthClaims) SetFromJWT(tokenString string, keys *KeyRing) error {
 	token, err := jwt.ParseWithClaims(tokenString, ac,
 		func(t *jwt.Token) (interface{}, error) {
-			return []byte(key), nil
+			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+			}
+			kid, ok := t.Header["kid"].(string)
+			if !ok {
+				return nil, errors.New("token has no kid header")
+			}
+			key, err := keys.VerificationKey(kid)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(key.Secret), nil
 		})
 	if err != nil {
 		ac.UserID = ""
@@ -26,6 +26,8 @@ func (st *SafeTime) Set(val time.Time) {
 
 type CtxCancelWaiter struct {
 	waitUntil  SafeTime
+	changedM   sync.Mutex
+	changed    chan struct{} // Closed when waitUntil is changed by SetTimeUntil
 	interval   time.Duration
 	Ctx        context.Context
 	objectName string
@@ -35,9 +37,17 @@ type CtxCancelWaiter struct {
 func NewCtxCancelWaiter(ctx context.Context, interval time.Duration) *CtxCancelWaiter {
 	return &CtxCancelWaiter{Ctx: ctx,
 		interval:  interval,
+		changed:   make(chan struct{}),
 		waitUntil: SafeTime{time: time.Now()}}
 }
 
+func (ccw *CtxCancelWaiter) changedCh() <-chan struct{} {
+	ccw.changedM.Lock()
+	defer ccw.changedM.Unlock()
+	return ccw.changed
+}
+
+// Scan blocks until waitUntil moment or context cancellation. Wakes up immediately, if waitUntil is changed.
 func (ccw *CtxCancelWaiter) Scan() error {
 	var tUntil time.Time
 	for {
@@ -45,18 +55,30 @@ func (ccw *CtxCancelWaiter) Scan() error {
 			return err
 		}
 
+		changed := ccw.changedCh()
 		tUntil = ccw.waitUntil.Get()
-		if tUntil.Before(time.Now()) {
+		wait := time.Until(tUntil)
+		if wait < 0 {
 			if ccw.interval > 0 {
 				ccw.waitUntil.Set(tUntil.Add(ccw.interval))
 			}
 			return nil
 		}
 
-		time.Sleep(10 * time.Millisecond)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ccw.Ctx.Done():
+		case <-timer.C:
+		case <-changed:
+		}
+		timer.Stop()
 	}
 }
 
 func (ccw *CtxCancelWaiter) SetTimeUntil(time time.Time) {
 	ccw.waitUntil.Set(time)
+	ccw.changedM.Lock()
+	defer ccw.changedM.Unlock()
+	close(ccw.changed)
+	ccw.changed = make(chan struct{})
 }
@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoSigningKey error = errors.New("no active JWT signing key")
+var ErrUnknownKeyID error = errors.New("unknown JWT key id")
+
+//////////////////////////
+// SigningKey: HMAC secret with rotation schedule
+//////////////////////////
+
+type SigningKey struct {
+	ID         string    `json:"kid"`
+	Secret     string    `json:"secret"`
+	ActiveFrom time.Time `json:"active_from"` // Key is not used before this moment
+	RetireAt   time.Time `json:"retire_at"`   // Key stops signing at this moment (zero - never)
+}
+
+// Key is used for signing new tokens only within [ActiveFrom, RetireAt)
+func (sk SigningKey) canSign(now time.Time) bool {
+	return !now.Before(sk.ActiveFrom) && (sk.RetireAt.IsZero() || now.Before(sk.RetireAt))
+}
+
+// Retired key still verifies tokens, signed before retirement, until they expire
+func (sk SigningKey) canVerify(now time.Time) bool {
+	return !now.Before(sk.ActiveFrom) && (sk.RetireAt.IsZero() || now.Before(sk.RetireAt.Add(TokenExp)))
+}
+
+//////////////////////////
+// KeyRing
+//////////////////////////
+
+type KeyRing struct {
+	m      sync.RWMutex
+	keys   []SigningKey // Sorted by ActiveFrom
+	inline []SigningKey // Keys from configuration, merged with key file on every reload
+	file   string
+}
+
+func NewKeyRing(keys ...SigningKey) (*KeyRing, error) {
+	kr := &KeyRing{}
+	if err := kr.set(keys); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// NewEphemeralKeyRing creates key ring with single random key. Tokens are invalidated on restart.
+func NewEphemeralKeyRing() (*KeyRing, error) {
+	secret := make([]byte, 128)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+	return NewKeyRing(SigningKey{ID: hex.EncodeToString(kid), Secret: hex.EncodeToString(secret)})
+}
+
+// LoadKeyRing loads keys from inline definition ("kid1:secret1,kid2:secret2", later key signs)
+// and from JSON key file (array of SigningKey). Both sources are merged.
+func LoadKeyRing(inline string, file string) (*KeyRing, error) {
+	inlineKeys, err := parseInlineKeys(inline)
+	if err != nil {
+		return nil, err
+	}
+	kr := &KeyRing{inline: inlineKeys, file: file}
+	if err = kr.load(); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// load merges inline keys with keys of key file. Inline keys go first, so key file key with the same
+// ActiveFrom signs.
+func (kr *KeyRing) load() error {
+	keys := make([]SigningKey, 0, len(kr.inline))
+	keys = append(keys, kr.inline...)
+	if kr.file != "" {
+		fileKeys, err := readKeyFile(kr.file)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	return kr.set(keys)
+}
+
+func parseInlineKeys(inline string) ([]SigningKey, error) {
+	keys := make([]SigningKey, 0)
+	if strings.TrimSpace(inline) == "" {
+		return keys, nil
+	}
+	for _, v := range strings.Split(inline, ",") {
+		kid, secret, ok := strings.Cut(strings.TrimSpace(v), ":")
+		if !ok || kid == "" || secret == "" {
+			return nil, fmt.Errorf("incorrect JWT key definition %q, want kid:secret", v)
+		}
+		keys = append(keys, SigningKey{ID: kid, Secret: secret})
+	}
+	return keys, nil
+}
+
+func readKeyFile(file string) ([]SigningKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []SigningKey
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("key file %s: %w", file, err)
+	}
+	return keys, nil
+}
+
+func (kr *KeyRing) set(keys []SigningKey) error {
+	if len(keys) == 0 {
+		return ErrNoSigningKey
+	}
+	ids := make(map[string]struct{}, len(keys))
+	for _, v := range keys {
+		if v.ID == "" || v.Secret == "" {
+			return errors.New("JWT key must have both kid and secret")
+		}
+		if _, ok := ids[v.ID]; ok {
+			return fmt.Errorf("duplicate JWT key id %q", v.ID)
+		}
+		ids[v.ID] = struct{}{}
+	}
+	sorted := make([]SigningKey, len(keys))
+	copy(sorted, keys)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].ActiveFrom.Before(sorted[j].ActiveFrom) })
+
+	kr.m.Lock()
+	defer kr.m.Unlock()
+	kr.keys = sorted
+	return nil
+}
+
+// Reload re-reads key file, so rotation does not require restart. Inline keys are kept.
+// If key file is broken, current keys stay in use.
+func (kr *KeyRing) Reload() error {
+	if kr.file == "" {
+		return nil
+	}
+	return kr.load()
+}
+
+func (kr *KeyRing) File() string {
+	return kr.file
+}
+
+// SigningKey returns most recently activated key, which is allowed to sign
+func (kr *KeyRing) SigningKey() (SigningKey, error) {
+	kr.m.RLock()
+	defer kr.m.RUnlock()
+	now := time.Now()
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].canSign(now) {
+			return kr.keys[i], nil
+		}
+	}
+	return SigningKey{}, ErrNoSigningKey
+}
+
+// VerificationKey returns key by kid, if it is still allowed to verify tokens
+func (kr *KeyRing) VerificationKey(kid string) (SigningKey, error) {
+	kr.m.RLock()
+	defer kr.m.RUnlock()
+	now := time.Now()
+	for _, v := range kr.keys {
+		if v.ID == kid && v.canVerify(now) {
+			return v, nil
+		}
+	}
+	return SigningKey{}, fmt.Errorf("%s: %w", kid, ErrUnknownKeyID)
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func signedKid(t *testing.T, keys *KeyRing) (string, string) {
+	token, err := (&AuthClaims{UserID: "user"}).GetJWT(keys)
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &AuthClaims{})
+	require.NoError(t, err)
+	return token, parsed.Header["kid"].(string)
+}
+
+func writeKeyFile(t *testing.T, file string, keys ...SigningKey) {
+	data, err := json.Marshal(keys)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, data, 0600))
+}
+
+func TestKeyRing(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Most recently activated key signs", func(t *testing.T) {
+		keys, err := NewKeyRing(
+			SigningKey{ID: "new", Secret: "s2", ActiveFrom: now.Add(-time.Minute)},
+			SigningKey{ID: "old", Secret: "s1", ActiveFrom: now.Add(-time.Hour)},
+			SigningKey{ID: "future", Secret: "s3", ActiveFrom: now.Add(time.Hour)},
+		)
+		require.NoError(t, err)
+
+		_, kid := signedKid(t, keys)
+		assert.Equal(t, "new", kid)
+	})
+
+	t.Run("Retired key verifies until tokens expire", func(t *testing.T) {
+		old := SigningKey{ID: "old", Secret: "s1", ActiveFrom: now.Add(-time.Hour)}
+		before, err := NewKeyRing(old)
+		require.NoError(t, err)
+		token, _ := signedKid(t, before)
+
+		old.RetireAt = now.Add(-time.Minute)
+		after, err := NewKeyRing(old, SigningKey{ID: "new", Secret: "s2", ActiveFrom: now.Add(-time.Minute)})
+		require.NoError(t, err)
+		var claims AuthClaims
+		require.NoError(t, claims.SetFromJWT(token, after))
+		assert.Equal(t, "user", claims.UserID)
+		_, kid := signedKid(t, after)
+		assert.Equal(t, "new", kid, "Retired key must not sign")
+
+		old.RetireAt = now.Add(-TokenExp - time.Minute)
+		expired, err := NewKeyRing(old, SigningKey{ID: "new", Secret: "s2"})
+		require.NoError(t, err)
+		_, err = expired.VerificationKey("old")
+		assert.ErrorIs(t, err, ErrUnknownKeyID)
+	})
+
+	t.Run("Unknown kid is rejected", func(t *testing.T) {
+		signer, err := NewKeyRing(SigningKey{ID: "a", Secret: "s1"})
+		require.NoError(t, err)
+		token, _ := signedKid(t, signer)
+
+		verifier, err := NewKeyRing(SigningKey{ID: "b", Secret: "s1"})
+		require.NoError(t, err)
+		var claims AuthClaims
+		err = claims.SetFromJWT(token, verifier)
+		assert.ErrorIs(t, err, ErrUnknownKeyID)
+		assert.Empty(t, claims.UserID)
+	})
+
+	t.Run("Reload keeps inline keys", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "keys.json")
+		writeKeyFile(t, file, SigningKey{ID: "file1", Secret: "f1", ActiveFrom: now.Add(-time.Minute)})
+		keys, err := LoadKeyRing("inline:i1", file)
+		require.NoError(t, err)
+		inlineOnly, err := NewKeyRing(SigningKey{ID: "inline", Secret: "i1"})
+		require.NoError(t, err)
+		inlineToken, _ := signedKid(t, inlineOnly)
+		_, kid := signedKid(t, keys)
+		assert.Equal(t, "file1", kid)
+
+		writeKeyFile(t, file, SigningKey{ID: "file2", Secret: "f2", ActiveFrom: now.Add(-time.Second)})
+		require.NoError(t, keys.Reload())
+		_, kid = signedKid(t, keys)
+		assert.Equal(t, "file2", kid)
+		_, err = keys.VerificationKey("file1")
+		assert.ErrorIs(t, err, ErrUnknownKeyID, "Key removed from file must be dropped")
+		var claims AuthClaims
+		require.NoError(t, claims.SetFromJWT(inlineToken, keys), "Inline key must survive reload")
+
+		require.NoError(t, os.WriteFile(file, []byte("{"), 0600))
+		assert.Error(t, keys.Reload())
+		_, err = keys.VerificationKey("file2")
+		assert.NoError(t, err, "Broken key file must not drop current keys")
+	})
+
+	t.Run("Duplicate kid of inline key and key file", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "keys.json")
+		writeKeyFile(t, file, SigningKey{ID: "a", Secret: "f1"})
+		_, err := LoadKeyRing("a:i1", file)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+//////////////////////////
+// RetryPolicy: exponential backoff with jitter and give-up limits
+//////////////////////////
+
+type RetryPolicy struct {
+	BaseDelay   time.Duration // Delay after first attempt
+	MaxDelay    time.Duration // Upper bound of delay
+	Jitter      float64       // Part of delay, which is randomized: delay * (1 ± Jitter)
+	MaxAge      time.Duration // Task is given up after this time (0 - never)
+	MaxAttempts int           // Task is given up after this number of attempts (0 - never)
+}
+
+// Delay returns pause before next attempt, attempt is number of already made attempts (starting from 1)
+func (rp RetryPolicy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(rp.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if rp.MaxDelay > 0 && delay > float64(rp.MaxDelay) {
+		delay = float64(rp.MaxDelay)
+	}
+	if rp.Jitter > 0 {
+		delay *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// GiveUp reports whether task exceeded policy limits after attempts made since given moment
+func (rp RetryPolicy) GiveUp(attempts int, since time.Time) bool {
+	if rp.MaxAttempts > 0 && attempts >= rp.MaxAttempts {
+		return true
+	}
+	if rp.MaxAge > 0 && time.Since(since) >= rp.MaxAge {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	t.Run("Exponential backoff capped by max delay", func(t *testing.T) {
+		rp := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+		assert.Equal(t, time.Second, rp.Delay(0))
+		assert.Equal(t, time.Second, rp.Delay(1))
+		assert.Equal(t, 2*time.Second, rp.Delay(2))
+		assert.Equal(t, 8*time.Second, rp.Delay(4))
+		assert.Equal(t, 10*time.Second, rp.Delay(5))
+		assert.Equal(t, 10*time.Second, rp.Delay(1000))
+	})
+
+	t.Run("Jitter bounds", func(t *testing.T) {
+		rp := RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			d := rp.Delay(3)
+			assert.GreaterOrEqual(t, d, 2*time.Second)
+			assert.LessOrEqual(t, d, 6*time.Second)
+		}
+	})
+
+	t.Run("Give up", func(t *testing.T) {
+		rp := RetryPolicy{BaseDelay: time.Second, MaxAge: time.Hour, MaxAttempts: 10}
+		assert.False(t, rp.GiveUp(9, time.Now()))
+		assert.True(t, rp.GiveUp(10, time.Now()))
+		assert.True(t, rp.GiveUp(1, time.Now().Add(-2*time.Hour)))
+
+		unlimited := RetryPolicy{BaseDelay: time.Second}
+		assert.False(t, unlimited.GiveUp(1000000, time.Now().Add(-1000*time.Hour)))
+	})
+}
@@ -0,0 +1,59 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////
+// Payload signature
+//////////////////////////
+
+// Request headers of webhook delivery
+const (
+	HeaderSignature = "X-Webhook-Signature" // t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">
+	HeaderEventID   = "X-Webhook-Id"        // Same for all attempts and endpoints, receiver deduplicates by it
+	HeaderEventType = "X-Webhook-Event"
+	HeaderAttempt   = "X-Webhook-Attempt"
+)
+
+// Sign returns signature header value of body sent at timestamp. Timestamp is signed to prevent replay of old requests.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", ts, signature(secret, ts, body))
+}
+
+func signature(secret string, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks signature header of received body, it is not older than tolerance (0 - any age). For use by receivers.
+func Verify(secret string, header string, body []byte, tolerance time.Duration) bool {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			ts = val
+		case "v1":
+			sig = val
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return false
+	}
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(signature(secret, ts, body)))
+}
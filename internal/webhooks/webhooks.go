@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+const maxErrorBodySize = 256 // Part of failed response body saved in delivery log
+
+// Payload: request body of webhook delivery
+type Payload struct {
+	ID        int64               `json:"id"`
+	Type      string              `json:"type"`
+	CreatedAt storage.RFC3339Time `json:"created_at"`
+	Data      json.RawMessage     `json:"data"`
+}
+
+type WebhookWorker struct {
+	s          *storage.Storage
+	wg         *sync.WaitGroup
+	logger     *zap.Logger
+	client     *http.Client
+	ccw        *utils.CtxCancelWaiter
+	policy     utils.RetryPolicy
+	pollPeriod time.Duration // Period of dispatching outbox events and claiming due deliveries
+	lease      time.Duration // How long claimed delivery is hidden from other workers
+	batch      int           // Deliveries claimed at once
+	eventsTTL  time.Duration
+}
+
+func NewWebhookWorker(
+	ccw *utils.CtxCancelWaiter,
+	s *storage.Storage,
+	wg *sync.WaitGroup,
+	logger *zap.Logger,
+	timeout time.Duration,
+	policy utils.RetryPolicy,
+	pollPeriod time.Duration,
+	eventsTTL time.Duration) *WebhookWorker {
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = 10 * time.Second
+	}
+	if pollPeriod <= 0 {
+		pollPeriod = 2 * time.Second
+	}
+	return &WebhookWorker{
+		s:          s,
+		wg:         wg,
+		logger:     logger,
+		client:     &http.Client{Timeout: timeout},
+		ccw:        ccw,
+		policy:     policy,
+		pollPeriod: pollPeriod,
+		lease:      timeout + time.Minute,
+		batch:      10,
+		eventsTTL:  eventsTTL,
+	}
+}
+
+func (ww *WebhookWorker) Start(numWorkers int) {
+	if ww.eventsTTL > 0 {
+		ww.wg.Add(1)
+		go ww.PurgeEvents()
+	}
+	for i := 1; i <= numWorkers; i++ {
+		ww.wg.Add(1)
+		go ww.DoWork(i)
+	}
+}
+
+// PurgeEvents hourly deletes old events with their delivery log
+func (ww *WebhookWorker) PurgeEvents() {
+	defer ww.wg.Done()
+	ccw := utils.NewCtxCancelWaiter(ww.ccw.Ctx, time.Hour)
+	for {
+		if ccw.Scan() != nil {
+			ww.logger.Info("Webhook events purge worker stopped")
+			return
+		}
+		purged, err := ww.s.PurgeWebhookEvents(ccw.Ctx, ww.eventsTTL)
+		if err != nil {
+			ww.logger.Sugar().Errorf("Unable to purge webhook events: %s", err.Error())
+			continue
+		}
+		if purged > 0 {
+			ww.logger.Sugar().Infof("Webhook events purged: %d", purged)
+		}
+	}
+}
+
+func (ww *WebhookWorker) DoWork(id int) {
+	ww.logger.Info(fmt.Sprintf("Webhook worker %d started", id))
+	defer func() {
+		ww.logger.Info(fmt.Sprintf("Webhook worker %d stopped", id))
+		ww.wg.Done()
+	}()
+
+	ccw := utils.NewCtxCancelWaiter(ww.ccw.Ctx, ww.pollPeriod)
+	for {
+		if ccw.Scan() != nil {
+			return
+		}
+
+		if _, err := ww.s.DispatchWebhookEvents(ccw.Ctx); err != nil {
+			ww.logger.Sugar().Errorf("Unable to dispatch webhook events: %s", err.Error())
+		}
+
+		// Full batch means there could be more due deliveries
+		for {
+			deliveries, err := ww.s.ClaimWebhookDeliveries(ccw.Ctx, ww.batch, ww.lease)
+			if err != nil {
+				ww.logger.Sugar().Errorf("Unable to claim webhook deliveries: %s", err.Error())
+				break
+			}
+			for _, d := range deliveries {
+				attempt := ww.deliver(ccw.Ctx, d)
+				if err = ww.s.FinishWebhookAttempt(ccw.Ctx, d.ID, attempt); err != nil {
+					ww.logger.Error(err.Error())
+				}
+			}
+			if len(deliveries) < ww.batch || ccw.Ctx.Err() != nil {
+				break
+			}
+		}
+	}
+}
+
+// deliver sends event to endpoint and returns result of attempt
+func (ww *WebhookWorker) deliver(ctx context.Context, d storage.WebhookDelivery) storage.WebhookAttempt {
+	var res storage.WebhookAttempt
+	statusCode, err := ww.send(ctx, d)
+	res.StatusCode = statusCode
+	if err == nil {
+		res.Delivered = true
+		ww.logger.Sugar().Infof("Webhook event %d (%s) delivered to %s", d.EventID, d.EventType, d.URL)
+		return res
+	}
+
+	res.Error = err.Error()
+	if ww.policy.GiveUp(d.Attempts, d.CreatedAt) {
+		ww.logger.Sugar().Errorf("Webhook event %d delivery to %s failed after %d attempts: %s", d.EventID, d.URL, d.Attempts, res.Error)
+		return res
+	}
+	res.NextAttemptAt = time.Now().Add(ww.policy.Delay(d.Attempts))
+	ww.logger.Sugar().Warnf("Webhook event %d delivery to %s failed, attempt %d: %s", d.EventID, d.URL, d.Attempts, res.Error)
+	return res
+}
+
+// send makes delivery request. Any 2xx response is success.
+func (ww *WebhookWorker) send(ctx context.Context, d storage.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(Payload{
+		ID:        d.EventID,
+		Type:      d.EventType,
+		CreatedAt: storage.RFC3339Time(d.CreatedAt),
+		Data:      json.RawMessage(d.Data),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gophermart-webhooks")
+	req.Header.Set(HeaderEventID, strconv.FormatInt(d.EventID, 10))
+	req.Header.Set(HeaderEventType, d.EventType)
+	req.Header.Set(HeaderAttempt, strconv.Itoa(d.Attempts))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, time.Now(), body))
+
+	resp, err := ww.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("response code %d, body: %s", resp.StatusCode, respBody)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,102 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"yapracticum-go-diploma-1/internal/storage"
+	"yapracticum-go-diploma-1/internal/utils"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	header := Sign("secret", time.Now(), body)
+
+	assert.True(t, Verify("secret", header, body, time.Minute))
+	assert.False(t, Verify("other", header, body, time.Minute))
+	assert.False(t, Verify("secret", header, []byte(`{"id":2}`), time.Minute))
+	assert.False(t, Verify("secret", "v1=abc", body, 0))
+
+	old := Sign("secret", time.Now().Add(-time.Hour), body)
+	assert.False(t, Verify("secret", old, body, time.Minute))
+	assert.True(t, Verify("secret", old, body, 0))
+}
+
+func TestDeliver(t *testing.T) {
+	var received Payload
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", r.Header.Get(HeaderSignature), body, time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal(body, &received)
+		assert.Equal(t, "7", r.Header.Get(HeaderEventID))
+		assert.Equal(t, storage.WebhookOrderProcessed, r.Header.Get(HeaderEventType))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/broken", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("upstream is down"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ww := NewWebhookWorker(utils.NewCtxCancelWaiter(context.Background(), 0), nil, &sync.WaitGroup{}, zap.NewNop(),
+		time.Second, utils.RetryPolicy{BaseDelay: time.Minute, MaxAttempts: 3}, time.Second, 0)
+	delivery := storage.WebhookDelivery{
+		ID:        1,
+		URL:       server.URL + "/ok",
+		Secret:    "secret",
+		EventID:   7,
+		EventType: storage.WebhookOrderProcessed,
+		Data:      []byte(`{"user_id":"u1"}`),
+		CreatedAt: time.Now(),
+		Attempts:  1,
+	}
+
+	t.Run("Delivered", func(t *testing.T) {
+		res := ww.deliver(context.Background(), delivery)
+		assert.True(t, res.Delivered)
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		assert.Equal(t, int64(7), received.ID)
+		assert.JSONEq(t, `{"user_id":"u1"}`, string(received.Data))
+	})
+
+	t.Run("Retried", func(t *testing.T) {
+		d := delivery
+		d.URL = server.URL + "/broken"
+		res := ww.deliver(context.Background(), d)
+		assert.False(t, res.Delivered)
+		assert.Equal(t, http.StatusBadGateway, res.StatusCode)
+		assert.Contains(t, res.Error, "upstream is down")
+		assert.WithinDuration(t, time.Now().Add(time.Minute), res.NextAttemptAt, 5*time.Second)
+	})
+
+	t.Run("Failed after last attempt", func(t *testing.T) {
+		d := delivery
+		d.URL = server.URL + "/broken"
+		d.Attempts = 3
+		res := ww.deliver(context.Background(), d)
+		assert.False(t, res.Delivered)
+		assert.True(t, res.NextAttemptAt.IsZero())
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		d := delivery
+		d.URL = "http://127.0.0.1:1/"
+		res := ww.deliver(context.Background(), d)
+		require.NotEmpty(t, res.Error)
+		assert.Equal(t, 0, res.StatusCode)
+		assert.False(t, res.NextAttemptAt.IsZero())
+	})
+}